@@ -0,0 +1,326 @@
+package chatsrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 6
+
+// ErrNoAccount is returned by an AccountStore when no account is registered to a nick.
+var ErrNoAccount = errors.New("No account is registered to that nick")
+
+// ErrAccountExists is returned by an AccountStore when creating an account for a nick that is already registered.
+var ErrAccountExists = errors.New("That nick is already registered")
+
+// errPasswordChanged is returned by /passwd's update when the password changed after the old one was checked
+var errPasswordChanged = errors.New("Password changed while it was being checked")
+
+// Account is a registered nick.
+// Only someone who knows the password can use the nick.
+type Account struct {
+	Nick         string    // Nick as it was registered
+	PasswordHash []byte    // bcrypt hash of the password
+	Registered   time.Time // When the account was created
+	Preferences  Preferences
+}
+
+// SetPassword hashes password, and stores the hash in the account.
+func (account *Account) SetPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return errors.Wrap(err, "Cannot hash password")
+	}
+
+	account.PasswordHash = hash
+	return nil
+}
+
+// CheckPassword returns true if password is the account's password.
+func (account *Account) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword(account.PasswordHash, []byte(password)) == nil
+}
+
+// AccountStore stores registered accounts.
+// Nicks are looked up without regard to case.
+// Implementations must be safe to use from multiple goroutines.
+type AccountStore interface {
+	// Account gets the account registered to nick.
+	// If there is none, it returns ErrNoAccount.
+	Account(nick string) (*Account, error)
+	// CreateAccount saves a new account.
+	// If the nick is already registered, it returns ErrAccountExists.
+	CreateAccount(account *Account) error
+	// UpdateAccount changes the account registered to nick with update, and saves it.
+	// Nothing else can change the account while update runs, so changes can't be lost;
+	// update should be quick, as other accounts can't be used meanwhile either.
+	// If update returns an error, the account isn't changed, and the error is returned.
+	// If there is no account, it returns ErrNoAccount.
+	UpdateAccount(nick string, update func(account *Account) error) error
+}
+
+// FileAccountStore is an AccountStore that keeps accounts in a JSON file.
+// The whole file is loaded into memory, and rewritten when an account is saved.
+type FileAccountStore struct {
+	path     string
+	lock     sync.RWMutex        // protects accounts
+	accounts map[string]*Account // Keyed by lowercase nick
+}
+
+// NewFileAccountStore creates a FileAccountStore that keeps accounts in the file at path.
+// Accounts already in the file are loaded. If the file doesn't exist, it will be created when the first account is saved.
+func NewFileAccountStore(path string) (*FileAccountStore, error) {
+	store := &FileAccountStore{
+		path:     path,
+		accounts: make(map[string]*Account),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot read accounts")
+	}
+
+	var accounts []*Account
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, errors.Wrapf(err, "Cannot parse accounts in %s", path)
+	}
+	for _, account := range accounts {
+		store.accounts[strings.ToLower(account.Nick)] = account
+	}
+
+	log.Printf("Loaded %d accounts from %s\n", len(store.accounts), path)
+	return store, nil
+}
+
+// Account gets the account registered to nick.
+func (store *FileAccountStore) Account(nick string) (*Account, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	account, ok := store.accounts[strings.ToLower(nick)]
+	if !ok {
+		return nil, ErrNoAccount
+	}
+
+	// Return a copy, so callers can't change the stored account without saving it
+	accountCopy := *account
+	return &accountCopy, nil
+}
+
+// CreateAccount saves a new account, and writes all accounts to the file.
+func (store *FileAccountStore) CreateAccount(account *Account) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	key := strings.ToLower(account.Nick)
+	if _, exists := store.accounts[key]; exists {
+		return ErrAccountExists
+	}
+
+	accountCopy := *account
+	store.accounts[key] = &accountCopy
+	if err := store.write(); err != nil {
+		delete(store.accounts, key)
+		return err
+	}
+	return nil
+}
+
+// UpdateAccount changes the account registered to nick, and writes all accounts to the file.
+func (store *FileAccountStore) UpdateAccount(nick string, update func(account *Account) error) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	key := strings.ToLower(nick)
+	account, ok := store.accounts[key]
+	if !ok {
+		return ErrNoAccount
+	}
+
+	// Change a copy, so the stored account is left alone if anything fails
+	accountCopy := *account
+	if err := update(&accountCopy); err != nil {
+		return err
+	}
+	store.accounts[key] = &accountCopy
+	if err := store.write(); err != nil {
+		store.accounts[key] = account
+		return err
+	}
+	return nil
+}
+
+// write writes all accounts to the file.
+// Must be called with store.lock held.
+func (store *FileAccountStore) write() error {
+	accounts := make([]*Account, 0, len(store.accounts))
+	for _, account := range store.accounts {
+		accounts = append(accounts, account)
+	}
+
+	data, err := json.MarshalIndent(accounts, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "Cannot encode accounts")
+	}
+
+	return writeFileAtomically(store.path, data)
+}
+
+// writeFileAtomically replaces the file at path with data, readable only by its owner.
+// The data is written to a temporary file first, so a crash can't leave the file half written.
+func writeFileAtomically(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrap(err, "Cannot create directory")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "Cannot create temporary file")
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once the file is renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "Cannot write %s", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "Cannot write %s", tmp.Name())
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return errors.Wrapf(err, "Cannot set permissions on %s", tmp.Name())
+	}
+
+	return errors.Wrapf(os.Rename(tmp.Name(), path), "Cannot replace %s", path)
+}
+
+// Account commands
+
+// cmdRegister registers the user's current nick, so only they can use it
+var cmdRegister commandHandlerFunc = func(server *server, command *serverCommand) {
+	store := server.config.AccountStore
+	if store == nil {
+		command.responseChan <- errorReply("Accounts aren't enabled on this server.\n")
+		return
+	}
+	if len(command.args) != 1 {
+		command.responseChan <- errorReply("Use /register <password>\nYou'll need to enter the password whenever you connect with this nick.\n")
+		return
+	}
+	if account, ok := command.client.GetVar("account").(string); ok {
+		command.responseChan <- errorReply(fmt.Sprintf("You're already logged into the account %s.\n", account))
+		return
+	}
+
+	password := command.args[0]
+	if len(password) < minPasswordLength {
+		command.responseChan <- errorReply(fmt.Sprintf("Passwords must be at least %d characters long.\n", minPasswordLength))
+		return
+	}
+
+	_, err := store.Account(command.nick)
+	if err == nil {
+		command.responseChan <- errorReply("That nick is already registered.\n")
+		return
+	}
+	if err != ErrNoAccount {
+		log.Printf("Error looking up account for %s: %s\n", command.nick, err)
+		command.responseChan <- errorReply("Cannot register right now; try again later.\n")
+		return
+	}
+
+	// Hashing the password is slow on purpose; don't hold up the server while it happens.
+	account := &Account{Nick: command.nick, Registered: time.Now()}
+	go func() {
+		if err := account.SetPassword(password); err != nil {
+			log.Printf("Error registering %s: %s\n", account.Nick, err)
+			notifyLater(server, command, "Cannot register right now; try again later.\n")
+			return
+		}
+		if err := store.CreateAccount(account); err == ErrAccountExists {
+			notifyLater(server, command, "That nick is already registered.\n")
+			return
+		} else if err != nil {
+			log.Printf("Error registering %s: %s\n", account.Nick, err)
+			notifyLater(server, command, "Cannot register right now; try again later.\n")
+			return
+		}
+
+		command.client.SetVar("account", account.Nick)
+		log.Printf("Registered account %s for %s\n", account.Nick, command.client)
+		server.audit(command, auditEntry{Action: "register"})
+		notifyLater(server, command, fmt.Sprintf("Registered %s. You'll need your password whenever you connect with this nick.\n", account.Nick))
+	}()
+}
+
+// cmdPasswd changes the password of the account the user is logged into
+var cmdPasswd commandHandlerFunc = func(server *server, command *serverCommand) {
+	store := server.config.AccountStore
+	if store == nil {
+		command.responseChan <- errorReply("Accounts aren't enabled on this server.\n")
+		return
+	}
+	if len(command.args) != 2 {
+		command.responseChan <- errorReply("Use /passwd <oldpassword> <newpassword>\n")
+		return
+	}
+	accountNick, ok := command.client.GetVar("account").(string)
+	if !ok {
+		command.responseChan <- errorReply("You aren't logged into an account; /register one first.\n")
+		return
+	}
+
+	oldPassword, newPassword := command.args[0], command.args[1]
+	if len(newPassword) < minPasswordLength {
+		command.responseChan <- errorReply(fmt.Sprintf("Passwords must be at least %d characters long.\n", minPasswordLength))
+		return
+	}
+
+	go func() {
+		account, err := store.Account(accountNick)
+		if err != nil {
+			log.Printf("Error changing password for %s: %s\n", accountNick, err)
+			notifyLater(server, command, "Cannot change your password right now; try again later.\n")
+			return
+		}
+		if !account.CheckPassword(oldPassword) {
+			server.audit(command, auditEntry{Action: "password-failed", Details: "Wrong old password for /passwd"})
+			notifyLater(server, command, "Wrong password.\n")
+			return
+		}
+		// Hash the new password before locking the store, since it's slow;
+		// the change is only saved if nothing changed the password since the old one was checked.
+		oldHash := account.PasswordHash
+		if err := account.SetPassword(newPassword); err == nil {
+			err = store.UpdateAccount(accountNick, func(stored *Account) error {
+				if !bytes.Equal(stored.PasswordHash, oldHash) {
+					return errPasswordChanged
+				}
+				stored.PasswordHash = account.PasswordHash
+				return nil
+			})
+		}
+		if err == errPasswordChanged {
+			notifyLater(server, command, "Your password was changed meanwhile; try again.\n")
+			return
+		}
+		if err != nil {
+			log.Printf("Error changing password for %s: %s\n", accountNick, err)
+			notifyLater(server, command, "Cannot change your password right now; try again later.\n")
+			return
+		}
+
+		server.audit(command, auditEntry{Action: "passwd"})
+		notifyLater(server, command, "Password changed.\n")
+	}()
+}
@@ -0,0 +1,277 @@
+package chatsrv
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// Number of recent entries kept in memory, for /audit
+const auditRecentSize = 1000
+
+// Most entries /audit shows at once
+const auditMaxResults = 20
+
+// auditEntry is a line of the audit log, recording something security-relevant that happened,
+// such as someone connecting, a room being destroyed, or a moderator banning someone.
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`             // What happened, such as connect or kick
+	Nick     string    `json:"nick,omitempty"`     // Who did it
+	Operator string    `json:"operator,omitempty"` // Name the user logged in with /oper, if they are a server operator
+	Host     string    `json:"host,omitempty"`     // Where they connected from
+	Room     string    `json:"room,omitempty"`     // Room it happened in
+	Target   string    `json:"target,omitempty"`   // Who or what it was done to
+	Details  string    `json:"details,omitempty"`
+}
+
+// String formats an entry for people to read, such as:
+// [2017-04-01 12:00:00] alice kick bob in lobby: Spamming (from 192.0.2.1)
+func (entry auditEntry) String() string {
+	parts := []string{fmt.Sprintf("[%s]", entry.Time.Format("2006-01-02 15:04:05"))}
+	if entry.Nick != "" {
+		parts = append(parts, entry.Nick)
+	}
+	if entry.Operator != "" {
+		parts = append(parts, fmt.Sprintf("(operator %s)", entry.Operator))
+	}
+	parts = append(parts, entry.Action)
+	if entry.Target != "" {
+		parts = append(parts, entry.Target)
+	}
+	if entry.Room != "" {
+		parts = append(parts, "in "+entry.Room)
+	}
+
+	line := strings.Join(parts, " ")
+	if entry.Details != "" {
+		line += ": " + entry.Details
+	}
+	if entry.Host != "" {
+		line += fmt.Sprintf(" (from %s)", entry.Host)
+	}
+	return line
+}
+
+// matches returns true if every word of filter, which must be lower case, is in one of the entry's fields
+func (entry auditEntry) matches(filter []string) bool {
+	text := strings.ToLower(strings.Join([]string{entry.Action, entry.Nick, entry.Operator, entry.Host, entry.Room, entry.Target, entry.Details}, "\n"))
+	for _, word := range filter {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// auditLogger appends entries to the audit log, as a JSON object per line.
+// The file is opened when the first entry is written, and moved aside once it grows past maxSize bytes.
+// The most recent entries are also kept in memory, so operators can look through them.
+// It is safe to use from any goroutine.
+type auditLogger struct {
+	path    string // "" only keeps entries in memory
+	maxSize int64  // 0 is unlimited
+
+	lock   sync.Mutex // protects everything below
+	file   *os.File
+	size   int64
+	recent []auditEntry // Oldest first
+}
+
+// newAuditLogger creates an audit logger writing to path,
+// reading the entries already there so they can be looked through.
+func newAuditLogger(path string, maxSize int64) *auditLogger {
+	logger := &auditLogger{path: path, maxSize: maxSize}
+	if path != "" {
+		if err := logger.readRecent(); err != nil {
+			log.Printf("Cannot read audit log: %s\n", err)
+		}
+	}
+
+	return logger
+}
+
+// readRecent reads the most recent entries from the audit log file
+func (logger *auditLogger) readRecent() error {
+	file, err := os.Open(logger.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Cannot open audit log")
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		logger.remember(entry)
+	}
+
+	return errors.Wrap(scanner.Err(), "Cannot read audit log")
+}
+
+// log writes an entry to the audit log; if its time isn't set, it is set to now
+func (logger *auditLogger) log(entry auditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Cannot encode audit log entry: %s\n", err)
+		return
+	}
+	data = append(data, '\n')
+
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	logger.remember(entry)
+	if logger.path == "" {
+		return
+	}
+
+	if logger.file != nil && logger.maxSize > 0 && logger.size > 0 && logger.size+int64(len(data)) > logger.maxSize {
+		logger.file.Close()
+		logger.file = nil
+		if err := logger.moveAside(); err != nil {
+			log.Printf("Error rotating audit log: %s\n", err)
+		}
+	}
+	if logger.file == nil {
+		if err := logger.open(); err != nil {
+			log.Printf("Cannot open audit log: %s\n", err)
+			return
+		}
+	}
+
+	n, err := logger.file.Write(data)
+	logger.size += int64(n)
+	if err != nil {
+		log.Printf("Error writing audit log: %s\n", err)
+	}
+}
+
+// remember keeps an entry in memory, forgetting the oldest one if there are too many.
+// Must be called with logger.lock held, unless nothing else is using logger yet.
+func (logger *auditLogger) remember(entry auditEntry) {
+	if len(logger.recent) >= auditRecentSize {
+		copy(logger.recent, logger.recent[1:])
+		logger.recent = logger.recent[:len(logger.recent)-1]
+	}
+	logger.recent = append(logger.recent, entry)
+}
+
+// open opens the audit log file for appending.
+// Must be called with logger.lock held.
+func (logger *auditLogger) open() error {
+	if err := os.MkdirAll(filepath.Dir(logger.path), 0700); err != nil {
+		return errors.Wrap(err, "Cannot create audit log directory")
+	}
+	file, err := os.OpenFile(logger.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Cannot open audit log")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "Cannot open audit log")
+	}
+
+	logger.file = file
+	logger.size = info.Size()
+	return nil
+}
+
+// moveAside renames the audit log file, so a new one can be started.
+// It gets the first free number, such as audit.3.log; old files are never removed.
+// Must be called with logger.lock held.
+func (logger *auditLogger) moveAside() error {
+	ext := filepath.Ext(logger.path)
+	base := strings.TrimSuffix(logger.path, ext)
+	for i := 1; ; i++ {
+		path := fmt.Sprintf("%s.%d%s", base, i, ext)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+
+		return errors.Wrap(os.Rename(logger.path, path), "Cannot rotate audit log")
+	}
+}
+
+// search gets up to max of the most recent entries matching filter, oldest first.
+// filter is a list of lower case words, which must all be in an entry; if it is empty, every entry matches.
+func (logger *auditLogger) search(filter []string, max int) []auditEntry {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+
+	var found []auditEntry
+	for i := len(logger.recent) - 1; i >= 0 && len(found) < max; i-- {
+		if logger.recent[i].matches(filter) {
+			found = append(found, logger.recent[i])
+		}
+	}
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+
+	return found
+}
+
+func (logger *auditLogger) close() {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	if logger.file != nil {
+		logger.file.Close()
+		logger.file = nil
+	}
+}
+
+// audit records something the user who sent command did.
+// The entry's nick, host, and operator name are filled in from the command.
+func (server *server) audit(command *serverCommand, entry auditEntry) {
+	entry.Nick = command.nick
+	entry.Operator, _ = command.client.GetVar("oper_name").(string)
+	entry.Host = describeHost(command.client)
+	server.auditLogger.log(entry)
+}
+
+// cmdAudit shows recent audit log entries to operators, optionally only those containing all the words of a filter
+var cmdAudit commandHandlerFunc = func(server *server, command *serverCommand) {
+	if !requireOper(command) {
+		return
+	}
+
+	filter := strings.Fields(strings.ToLower(strings.Join(command.args, " ")))
+	entries := server.auditLogger.search(filter, auditMaxResults)
+	if len(entries) == 0 {
+		if len(filter) > 0 {
+			command.responseChan <- reply("No audit log entries match that.\n")
+		} else {
+			command.responseChan <- reply("The audit log is empty.\n")
+		}
+		return
+	}
+
+	response := make([]string, 0, len(entries)+1)
+	if len(filter) > 0 {
+		response = append(response, fmt.Sprintf("Recent audit log entries matching %s:", strings.Join(command.args, " ")))
+	} else {
+		response = append(response, "Recent audit log entries:")
+	}
+	for _, entry := range entries {
+		response = append(response, entry.String())
+	}
+	command.responseChan <- &event{Type: eventAudit, Time: time.Now(), Text: strings.Join(response, "\n") + "\n", Data: entries}
+}
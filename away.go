@@ -0,0 +1,140 @@
+package chatsrv
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Users can say they are away with /away, and are marked away by themselves after AutoAwayAfter without sending anything.
+// While a user is away, their "away" var is their away message, and "away_since" is when they went away.
+// "away_auto" is true if they were marked away for being idle; they are then back as soon as they send something.
+// Users who turn on the announceaway mode have their room told when they go away and come back.
+
+// Away message used when none is given
+const defaultAwayMessage = "Away"
+
+// Away message of users marked away for being idle
+const idleAwayMessage = "Idle"
+
+// How often users are checked for having been idle long enough to be marked away, at most
+const autoAwayCheckInterval = time.Minute
+
+// awayMessage gets a user's away message, and whether they are away
+func awayMessage(client *Client) (string, bool) {
+	message, ok := client.GetVar("away").(string)
+	return message, ok
+}
+
+// setAway marks a user away with message, telling them and, if they want, their room.
+// auto says they are being marked away for being idle.
+func setAway(server *server, nick string, client *Client, message string, auto bool) {
+	client.SetVar("away", message)
+	client.SetVar("away_since", time.Now())
+	client.SetVar("away_auto", auto)
+
+	text := fmt.Sprintf("You are now away: %s\n", message)
+	if auto {
+		text = fmt.Sprintf("You have been marked away after being idle for %s. Send anything to come back.\n", server.config.AutoAwayAfter)
+	}
+	if responseChan, ok := server.userResponseChan[nick]; ok {
+		responseChan <- &event{Type: eventAway, Time: time.Now(), From: nick, Body: message, Text: text}
+	}
+	announceAway(server, nick, client, fmt.Sprintf("%s is away: %s", nick, message))
+}
+
+// setBack marks a user who was away as back, telling them and, if they want, their room
+func setBack(server *server, nick string, client *Client) {
+	since, _ := client.GetVar("away_since").(time.Time)
+	client.UnsetVar("away")
+	client.UnsetVar("away_since")
+	client.UnsetVar("away_auto")
+
+	if responseChan, ok := server.userResponseChan[nick]; ok {
+		text := fmt.Sprintf("Welcome back! You were away for %s.\n", time.Since(since).Round(time.Second))
+		responseChan <- &event{Type: eventBack, Time: time.Now(), From: nick, Text: text}
+	}
+	announceAway(server, nick, client, fmt.Sprintf("%s is back", nick))
+}
+
+// announceAway tells the user's room that they went away or came back, if they turned on the announceaway mode
+func announceAway(server *server, nick string, client *Client, message string) {
+	if announce, _ := client.GetVar("announce_away").(bool); !announce {
+		return
+	}
+	if roomName := server.userActiveRoom[nick]; roomName != "" {
+		sayToRoom(server, roomName, message)
+	}
+}
+
+// describeAway says whether a user is away, and for how long, such as "Away: Lunch (went away 5 minutes ago)".
+// Returns "" if they aren't away.
+func describeAway(client *Client) string {
+	message, ok := awayMessage(client)
+	if !ok {
+		return ""
+	}
+	since, _ := client.GetVar("away_since").(time.Time)
+	return fmt.Sprintf("Away: %s (went away %s)", message, strings.ToLower(describeTimeSince(since)))
+}
+
+// comeBackIfIdleAway marks the user who sent command back, if they were marked away for being idle.
+// Only commands the user sent themselves count; /away and /back take care of it themselves.
+func comeBackIfIdleAway(server *server, command *serverCommand) {
+	if auto, _ := command.client.GetVar("away_auto").(bool); !auto {
+		return
+	}
+	if !command.sentByUser() {
+		return
+	}
+	if command.command == "away" || command.command == "back" {
+		return
+	}
+
+	setBack(server, command.nick, command.client)
+}
+
+// markIdleAway marks users who haven't sent anything in AutoAwayAfter away
+func (server *server) markIdleAway() {
+	for _, client := range server.clients {
+		if _, away := awayMessage(client); away {
+			continue
+		}
+		lastSeen, ok := client.GetVar("last_seen").(time.Time)
+		if !ok || time.Since(lastSeen) < server.config.AutoAwayAfter {
+			continue
+		}
+
+		nick, _ := client.GetVar("nick").(string)
+		setAway(server, nick, client, idleAwayMessage, true)
+	}
+}
+
+// autoAwayInterval gets how often to check for idle users, or 0 if they are never marked away
+func (server *server) autoAwayInterval() time.Duration {
+	interval := server.config.AutoAwayAfter / 4
+	if interval > autoAwayCheckInterval {
+		interval = autoAwayCheckInterval
+	}
+	return interval
+}
+
+// cmdAway marks the user away, with an optional message
+var cmdAway commandHandlerFunc = func(server *server, command *serverCommand) {
+	message := strings.Join(command.args, " ")
+	if message == "" {
+		message = defaultAwayMessage
+	}
+
+	setAway(server, command.nick, command.client, message, false)
+}
+
+// cmdBack marks the user as back
+var cmdBack commandHandlerFunc = func(server *server, command *serverCommand) {
+	if _, away := awayMessage(command.client); !away {
+		command.responseChan <- errorReply("You aren't away.\n")
+		return
+	}
+
+	setBack(server, command.nick, command.client)
+}
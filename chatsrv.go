@@ -2,13 +2,17 @@
 package chatsrv
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
 
 	"crypto/tls"
 )
@@ -17,36 +21,129 @@ const acceptBuffSize = 100 // Buffer size of channel for accepting commands
 
 // Contains state for the server
 type server struct {
-	config           ServerConfig
-	rooms            map[string]*room
-	clients          map[string]*Client
-	userActiveRoom   map[string]string
-	userResponseChan map[string]chan<- []byte
-	in               chan *serverCommand // Server accepts commands on this channel
-	runningLock      sync.Mutex          // protects running
-	running          bool
+	config            ServerConfig
+	rooms             map[string]*room
+	clients           map[string]*Client
+	userActiveRoom    map[string]string
+	userResponseChan  map[string]chan<- *event
+	in                chan *serverCommand // Server accepts commands on this channel
+	runningLock       sync.Mutex          // protects running, shuttingDown and the listeners
+	running           bool
+	shuttingDown      bool
+	listener          net.Listener
+	webServer         *http.Server
+	sshListener       net.Listener
+	ircListener       net.Listener
+	quit              chan struct{}  // Closed when the server starts shutting down
+	disconnected      chan struct{}  // Closed when all users have been removed during shutdown
+	connections       sync.WaitGroup // Tracks connected clients until their output has been flushed
+	roomsChanged      bool           // Persistent rooms changed since they were last saved
+	roomLogger        *roomLogger    // Writes rooms' logs; nil if logging is disabled
+	connectionLimiter *connectionLimiter
+	resolver          *hostResolver // Looks up the host names clients connect from; nil if they aren't looked up
+	bans              []*roomBan    // Server-wide bans
+	auditLogger       *auditLogger  // Records security-relevant events
 }
 
 type ServerConfig struct {
 	ServerName          string
 	BindAddr            string
+	WebBindAddr         string // Where browsers can connect; "" disables the web client
+	IRCBindAddr         string // Where IRC clients can connect; "" disables IRC
 	CertFile            string
 	KeyFile             string
 	UseTls              bool
 	Motd                string
 	MessageLineLimit    int
 	MessagePasteTimeout time.Duration
+	ShutdownMessage     string       // Sent to every client when the server shuts down
+	TopicHistorySize    int          // Number of previous topics to remember for each room
+	HistorySize         int          // Number of lines said in each room to remember
+	HistoryReplayLines  int          // Number of remembered lines shown to users when they join a room
+	AccountStore        AccountStore // Where registered accounts are kept; nil disables accounts
+	RoomsFile           string       // Where persistent rooms are saved; "" doesn't save them
+	PersistentRooms     []string     // Rooms that are always there
+	// Rooms with logging turned on are logged to files in LogDir ("" disables logging).
+	// Files are rotated each day, and when they grow past LogMaxSize bytes (0 is unlimited).
+	// If LogCompress is true, rotated files are compressed with gzip.
+	// If LogNewRooms is true, logging is turned on in new rooms.
+	LogDir      string
+	LogMaxSize  int64
+	LogCompress bool
+	LogNewRooms bool
+	// Data waiting to be sent to a client is queued, up to these limits (0 is unlimited).
+	// SendQueuePolicy decides what happens when a queue is full.
+	SendQueueMaxMessages int
+	SendQueueMaxBytes    int
+	SendQueuePolicy      SendQueuePolicy
+	// Where SSH clients can connect ("" disables SSH), the server's host key (generated if it doesn't exist),
+	// and the file listing which public keys can log in as which nicks.
+	SSHBindAddr           string
+	SSHHostKeyFile        string
+	SSHAuthorizedKeysFile string
+	TelnetCompression     bool // Offer MCCP2 compression to telnet clients
+	// Users can send a burst of messages, commands and nick changes, and then one more every refill interval
+	// (a burst or refill of 0 is unlimited). Users who keep sending too fast are warned, then throttled for FloodThrottleDuration,
+	// then muted for FloodMuteDuration, then disconnected; they start over after FloodResetAfter without sending too fast.
+	// Server operators aren't limited.
+	FloodMessageBurst     int
+	FloodMessageRefill    time.Duration
+	FloodCommandBurst     int
+	FloodCommandRefill    time.Duration
+	FloodNickBurst        int
+	FloodNickRefill       time.Duration
+	FloodThrottleDuration time.Duration
+	FloodMuteDuration     time.Duration
+	FloodResetAfter       time.Duration
+	AutoAwayAfter         time.Duration // Users who send nothing for this long are marked away; 0 never marks them away
+	// Each address can have MaxConnectionsPerIP connections open, and each /24 (or /64 for IPv6) MaxConnectionsPerNetwork.
+	// Each address can also make a burst of ConnectionRateBurst connections, and then one more every ConnectionRateRefill.
+	// 0 is unlimited. If AllowedNetworks isn't empty, only addresses in it can connect;
+	// addresses in DeniedNetworks can never connect. The networks can be changed later with SetNetworks.
+	MaxConnectionsPerIP      int
+	MaxConnectionsPerNetwork int
+	ConnectionRateBurst      int
+	ConnectionRateRefill     time.Duration
+	AllowedNetworks          []*net.IPNet
+	DeniedNetworks           []*net.IPNet
+	// Host names of clients are looked up by DNSWorkers goroutines (0 doesn't look them up), giving up after DNSTimeout.
+	// Up to DNSCacheSize results are remembered for DNSCacheTTL.
+	DNSWorkers   int
+	DNSTimeout   time.Duration
+	DNSCacheSize int
+	DNSCacheTTL  time.Duration
+	// Users logged into one of OperatorAccounts are server operators.
+	// Others can become operators with /oper and one of the names in Operators, mapped to bcrypt hashes of their passwords.
+	// Server-wide bans are saved in BansFile ("" doesn't save them).
+	OperatorAccounts []string
+	Operators        map[string]string
+	BansFile         string
+	// Security-relevant events, such as connections, nick changes, moderation, and wrong passwords,
+	// are written to AuditLogFile ("" only keeps recent ones in memory, for /audit).
+	// The file is moved aside once it grows past AuditLogMaxSize bytes (0 is unlimited).
+	AuditLogFile    string
+	AuditLogMaxSize int64
 }
 
 // NewServer creates a new server with the specified configuration
 func NewServer(config *ServerConfig) *server {
 	server := server{
-		config:           *config,
-		rooms:            make(map[string]*room),
-		clients:          make(map[string]*Client),
-		userActiveRoom:   make(map[string]string),
-		userResponseChan: make(map[string]chan<- []byte),
-		in:               make(chan *serverCommand, acceptBuffSize),
+		config:            *config,
+		rooms:             make(map[string]*room),
+		clients:           make(map[string]*Client),
+		userActiveRoom:    make(map[string]string),
+		userResponseChan:  make(map[string]chan<- *event),
+		in:                make(chan *serverCommand, acceptBuffSize),
+		quit:              make(chan struct{}),
+		disconnected:      make(chan struct{}),
+		connectionLimiter: newConnectionLimiter(config),
+		auditLogger:       newAuditLogger(config.AuditLogFile, config.AuditLogMaxSize),
+	}
+	if config.LogDir != "" {
+		server.roomLogger = newRoomLogger(config.LogDir, config.LogMaxSize, config.LogCompress)
+	}
+	if config.DNSWorkers > 0 {
+		server.resolver = newHostResolver(config.DNSWorkers, config.DNSTimeout, config.DNSCacheSize, config.DNSCacheTTL)
 	}
 
 	return &server
@@ -60,40 +157,85 @@ func (server *server) Start() {
 		log.Printf("Server is already running\n")
 		return
 	}
+	if server.shuttingDown {
+		server.runningLock.Unlock()
+		log.Printf("Server has been shut down\n")
+		return
+	}
 	server.running = true
 	server.runningLock.Unlock()
 
-	var listener net.Listener
-	var listenerErr error
-	if server.config.UseTls {
-		cert, err := tls.LoadX509KeyPair(server.config.CertFile, server.config.KeyFile)
-		if err != nil {
-			log.Printf("Error loading X.509 key pair: %s\n", err)
-			return
+	listener, err := server.listen(server.config.BindAddr)
+	if err != nil {
+		log.Printf("Cannot start the server, binding on %s; %s\n", server.config.BindAddr, err)
+		server.runningLock.Lock()
+		server.running = false
+		shuttingDown := server.shuttingDown
+		server.runningLock.Unlock()
+		if shuttingDown {
+			// Nobody can have connected, so this only lets Shutdown finish
+			server.disconnectAll()
 		}
+		return
+	}
 
-		tlsConf := &tls.Config{Certificates: []tls.Certificate{cert}}
-		listener, listenerErr = tls.Listen("tcp", server.config.BindAddr, tlsConf)
-		if listenerErr != nil {
-			log.Printf("Cannot start the server, binding on %s; %s\n", server.config.BindAddr, listenerErr)
-			return
-		}
+	server.runningLock.Lock()
+	if server.shuttingDown {
+		// Shutdown was called while the listener was being set up.
+		// Nobody can have connected yet either.
+		server.runningLock.Unlock()
+		listener.Close()
+		server.disconnectAll()
+		return
+	}
+	server.listener = listener
+	server.runningLock.Unlock()
+	if server.config.UseTls {
 		log.Printf("Listening on %s with TLS enabled\n", server.config.BindAddr)
 	} else {
-		listener, listenerErr = net.Listen("tcp", server.config.BindAddr)
-		if listenerErr != nil {
-			log.Printf("Cannot start the server, binding on %s; %s\n", server.config.BindAddr, listenerErr)
-			return
-		}
 		log.Printf("Listening on %s\n", server.config.BindAddr)
 	}
 
 	defer listener.Close()
 	go server.acceptCommands()
+	if server.config.WebBindAddr != "" {
+		go server.serveWeb()
+	}
+	if server.config.SSHBindAddr != "" {
+		go server.serveSSH()
+	}
+	if server.config.IRCBindAddr != "" {
+		go server.serveIRC()
+	}
 
+	server.acceptConnections(listener, "tcp", initServerClientHandler{server})
+	log.Printf("Stopped listening on %s\n", server.config.BindAddr)
+}
+
+// listen starts listening for connections on addr, with TLS if it is enabled
+func (server *server) listen(addr string) (net.Listener, error) {
+	if !server.config.UseTls {
+		return net.Listen("tcp", addr)
+	}
+
+	cert, err := tls.LoadX509KeyPair(server.config.CertFile, server.config.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error loading X.509 key pair")
+	}
+
+	tlsConf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	return tls.Listen("tcp", addr, tlsConf)
+}
+
+// acceptConnections accepts connections from listener, and hands them to handler, until the server shuts down.
+// transport says how the clients connected, such as "tcp".
+func (server *server) acceptConnections(listener net.Listener, transport string, handler ClientHandler) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if server.isShuttingDown() {
+				return
+			}
 			log.Printf("Error accepting connection: %s\n", err)
 			continue
 		}
@@ -102,29 +244,222 @@ func (server *server) Start() {
 			tcpConn.SetKeepAlivePeriod(15 * time.Second)
 		}
 
-		client, err := NewClient(conn, InputModeLines, initServerClientHandler{server})
+		remoteAddr, _, err := net.SplitHostPort(conn.RemoteAddr().String())
 		if err != nil {
-			log.Printf("Error creating client: %s\n", err)
-			continue
+			remoteAddr = conn.RemoteAddr().String()
 		}
+		server.addClient(conn, remoteAddr, transport, nil, handler, false)
+	}
+}
 
-		remoteAddr, _, err := net.SplitHostPort(conn.RemoteAddr().String())
-		remoteHost := getHostFromAddrIfPossible(remoteAddr)
-		log.Printf("Connected: %s from %s\n", client, remoteHost)
-		client.SetVar("remote_addr", remoteHost)
+// addClient puts a new connection onto the chat server, to be handled by handler.
+// transport says how the client connected, such as "tcp" or "websocket".
+// vars are set on the client before it is handled;
+// if they include "nick", initServerClientHandler doesn't ask for one.
+// Connections from addresses that aren't allowed, or that are over their limits, are refused.
+// If admitted is true, the connection was already let in by admitConnection, and addClient takes over releasing it.
+// Once the server is shutting down, connections are refused with the farewell message.
+func (server *server) addClient(rw io.ReadWriteCloser, remoteAddr, transport string, vars map[string]interface{}, handler ClientHandler, admitted bool) {
+	if !admitted {
+		if reason := server.admitConnection(remoteAddr, transport); reason != "" {
+			refuseConnection(rw, transport, reason)
+			return
+		}
+	}
+
+	// Checked with the lock held, so Shutdown can't start waiting for connections before this one is added
+	server.runningLock.Lock()
+	if server.shuttingDown {
+		server.runningLock.Unlock()
+		refuseConnection(rw, transport, strings.TrimSuffix(server.farewell(), "\n"))
+		server.connectionLimiter.release(remoteAddr)
+		return
+	}
+	server.connections.Add(1)
+	server.runningLock.Unlock()
+
+	// Plain connections are from telnet or MUD clients
+	var telnet *telnetConn
+	if transport == "tcp" {
+		telnet = newTelnetConn(rw, server.config.TelnetCompression)
+		rw = telnet
 	}
+
+	setVars := ClientHandlerFunc(func(client *Client) string {
+		client.SetVar("transport", transport)
+		client.SetVar("remote_addr", remoteAddr)
+		for name, value := range vars {
+			client.SetVar(name, value)
+		}
+		if telnet != nil {
+			telnet.attach(client)
+		}
+		return handler.Handle(client)
+	})
+	client, err := NewClient(rw, InputModeLines, setVars)
+	if err != nil {
+		log.Printf("Error creating client: %s\n", err)
+		rw.Close()
+		server.connectionLimiter.release(remoteAddr)
+		server.connections.Done()
+		return
+	}
+	go func() {
+		<-client.Finished()
+		server.connectionLimiter.release(remoteAddr)
+		server.connections.Done()
+	}()
+
+	log.Printf("Connected: %s from %s via %s\n", client, remoteAddr, transport)
+	if server.resolver != nil {
+		server.resolver.resolve(remoteAddr, func(host string) {
+			if host == "" {
+				return
+			}
+			log.Printf("%s is connecting from %s\n", client, host)
+			client.SetVar("remote_host", host)
+			// If the user already gave a nick, they might be on the server, and in a room, already.
+			// Otherwise, their bans are checked with the host name when they are added.
+			if nick, _ := client.GetVar("nick").(string); nick != "" {
+				server.in <- &serverCommand{nick: nick, client: client, command: "hostfound"}
+			}
+		})
+	}
+}
+
+// Shutdown gracefully stops the server.
+// It stops accepting connections, sends the farewell message to every user,
+// removes them from the server so their rooms see them leave,
+// and waits for everything sent to the clients to be written.
+// If ctx expires before that happens, Shutdown returns the context's error.
+func (server *server) Shutdown(ctx context.Context) error {
+	server.runningLock.Lock()
+	if !server.running {
+		server.runningLock.Unlock()
+		return fmt.Errorf("Server is not running")
+	}
+	if server.shuttingDown {
+		server.runningLock.Unlock()
+		return fmt.Errorf("Server is already shutting down")
+	}
+	server.shuttingDown = true
+	close(server.quit)
+	listener := server.listener
+	webServer := server.webServer
+	sshListener := server.sshListener
+	ircListener := server.ircListener
+	server.runningLock.Unlock()
+
+	log.Printf("Shutting down\n")
+	if listener != nil {
+		listener.Close()
+	}
+	if webServer != nil {
+		webServer.Close()
+	}
+	if sshListener != nil {
+		sshListener.Close()
+	}
+	if ircListener != nil {
+		ircListener.Close()
+	}
+
+	select {
+	case <-server.disconnected:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		server.connections.Wait()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		log.Printf("Shutdown complete\n")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isShuttingDown returns true once Shutdown has been called.
+func (server *server) isShuttingDown() bool {
+	select {
+	case <-server.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// farewell returns the message sent to clients when the server shuts down.
+func (server *server) farewell() string {
+	message := server.config.ShutdownMessage
+	if message == "" {
+		message = "The server is shutting down"
+	}
+
+	return message + "\n"
 }
 
 // Receives commands from the server's incoming channel, and processes them.
+// When the server starts shutting down, all users are disconnected.
+// Commands are still processed afterwards, so clients on their way out don't block.
 func (server *server) acceptCommands() {
-	for command := range server.in {
-		err := server.handleCommand(command)
-		if err != nil {
-			log.Printf("Error while processing command: %s\n", err)
+	quit := server.quit
+	var idleCheck <-chan time.Time
+	if interval := server.autoAwayInterval(); interval > 0 {
+		idleCheck = time.NewTicker(interval).C
+	}
+	var logCheck <-chan time.Time
+	if server.roomLogger != nil {
+		logCheck = time.NewTicker(roomLogCheckInterval).C
+	}
+	for {
+		select {
+		case command := <-server.in:
+			err := server.handleCommand(command)
+			if err != nil {
+				log.Printf("Error while processing command: %s\n", err)
+			}
+			server.saveRoomsIfChanged()
+		case <-idleCheck:
+			server.markIdleAway()
+		case <-logCheck:
+			server.roomLogger.closeOldFiles()
+		case <-quit:
+			server.disconnectAll()
+			quit = nil // Only disconnect everyone once
 		}
 	}
 }
 
+// disconnectAll says farewell to every user, and removes them from the server.
+// Must only be called from the goroutine running acceptCommands, or by Start before it is started.
+func (server *server) disconnectAll() {
+	defer close(server.disconnected)
+
+	for nick, responseChan := range server.userResponseChan {
+		client := server.clients[strings.ToLower(nick)]
+		responseChan <- reply(server.farewell())
+		cmdRmuser(server, &serverCommand{
+			nick:         nick,
+			client:       client,
+			responseChan: responseChan,
+			command:      "rmuser",
+			args:         []string{"Server shutting down"},
+		})
+	}
+
+	if server.roomLogger != nil {
+		server.roomLogger.close()
+	}
+	server.auditLogger.close()
+}
+
 // handleCommand looks up a command in the internalCommands or commands map, found in server-commands.go,
 // and if found, runs it.
 func (server *server) handleCommand(command *serverCommand) error {
@@ -141,15 +476,38 @@ func (server *server) handleCommand(command *serverCommand) error {
 		return fmt.Errorf("No client supplied in command")
 	}
 
+	// Commands sent before the user was disconnected, or before their nick was changed, can still be waiting.
+	// Their nick might belong to someone else by now, so they run as the user's current nick,
+	// or not at all if the user is gone, as their response channel might be closed.
+	if command.command != "adduser" && server.clients[strings.ToLower(command.nick)] != command.client {
+		nick, _ := command.client.GetVar("nick").(string)
+		if nick == "" || server.clients[strings.ToLower(nick)] != command.client {
+			log.Printf("Dropped command %s from %s, who is no longer on the server\n", command.command, command.client)
+			return nil
+		}
+		command.nick = nick
+	}
+
+	if command.responseChan == nil {
+		// Commands the server sends for a user, rather than their client, reply to the user
+		command.responseChan = server.userResponseChan[command.nick]
+	}
 	responseChan := command.responseChan
 	if responseChan == nil {
 		return fmt.Errorf("Received command, but no response channel; command: %q", command)
 	}
 
-	command.client.SetVar("last_seen", time.Now())
+	// Joining the server counts as being seen, so users who never send anything are still marked away
+	if command.sentByUser() || command.command == "adduser" {
+		command.client.SetVar("last_seen", time.Now())
+	}
+	comeBackIfIdleAway(server, command)
 
 	if command.command == "" {
-		responseChan <- []byte("No command specified\n")
+		responseChan <- errorReply("No command specified\n")
+		return nil
+	}
+	if !server.checkFlood(command) {
 		return nil
 	}
 
@@ -166,26 +524,10 @@ func (server *server) handleCommand(command *serverCommand) error {
 	}
 
 	if handler == nil {
-		responseChan <- []byte(fmt.Sprintf("Invalid command: %s\n", command.command))
+		responseChan <- errorReply(fmt.Sprintf("Invalid command: %s\n", command.command))
 		return nil
 	}
 
 	handler.Handle(server, command)
 	return nil
 }
-
-// getHostFromAddrIfPossible tries to get the reverse dns host for an address.
-// If that isn't possible, it just returns the address.
-func getHostFromAddrIfPossible(addr string) string {
-	var hosts string
-	names, err := net.LookupAddr(addr)
-	if err == nil { // No need to report errors; just fallback to IP
-		hosts = strings.Join(names, ", ")
-	}
-
-	if hosts == "" {
-		return addr
-	}
-
-	return fmt.Sprintf("%s (%s)", hosts, addr)
-}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"io/ioutil"
+	"net"
 	"os"
+	"os/signal"
 	"os/user"
 	"path"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/n0ot/chatsrv"
+	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 )
 
@@ -30,7 +35,42 @@ func init() {
 	viper.SetConfigType("toml")
 	viper.SetDefault("chat.messageLineLimit", 24)
 	viper.SetDefault("chat.messagePasteTimeout", 30) // MS
+	viper.SetDefault("chat.sendQueueMaxMessages", 200)
+	viper.SetDefault("chat.sendQueueMaxBytes", 256*1024)
+	viper.SetDefault("chat.sendQueuePolicy", "dropOldest")
+	viper.SetDefault("chat.topicHistorySize", 10)
+	viper.SetDefault("chat.historySize", 200)
+	viper.SetDefault("chat.historyReplayLines", 20)
+	viper.SetDefault("chat.floodMessageBurst", 5)
+	viper.SetDefault("chat.floodMessageRefill", 1000) // MS
+	viper.SetDefault("chat.floodCommandBurst", 10)
+	viper.SetDefault("chat.floodCommandRefill", 500) // MS
+	viper.SetDefault("chat.floodNickBurst", 3)
+	viper.SetDefault("chat.floodNickRefill", 30)       // Seconds
+	viper.SetDefault("chat.floodThrottleDuration", 30) // Seconds
+	viper.SetDefault("chat.floodMuteDuration", 120)    // Seconds
+	viper.SetDefault("chat.floodResetAfter", 300)      // Seconds
+	viper.SetDefault("chat.autoAwayAfter", 0)          // Seconds
+	viper.SetDefault("connections.maxPerIP", 10)
+	viper.SetDefault("connections.maxPerNetwork", 50)
+	viper.SetDefault("connections.rateBurst", 10)
+	viper.SetDefault("connections.rateRefill", 6) // Seconds
+	viper.SetDefault("dns.workers", 4)
+	viper.SetDefault("dns.timeout", 5) // Seconds
+	viper.SetDefault("dns.cacheSize", 1024)
+	viper.SetDefault("dns.cacheTTL", 3600) // Seconds
+	viper.SetDefault("audit.maxSize", 10*1024*1024)
+	viper.SetDefault("bansFile", path.Join(usr.HomeDir, ".chatsrv", "bans.json"))
 	viper.SetDefault("tls.useTls", false)
+	viper.SetDefault("shutdownTimeout", 10) // Seconds
+	viper.SetDefault("accountsFile", path.Join(usr.HomeDir, ".chatsrv", "accounts.json"))
+	viper.SetDefault("roomsFile", path.Join(usr.HomeDir, ".chatsrv", "rooms.json"))
+	viper.SetDefault("ssh.hostKeyFile", path.Join(usr.HomeDir, ".chatsrv", "ssh_host_key"))
+	viper.SetDefault("ssh.authorizedKeysFile", path.Join(usr.HomeDir, ".chatsrv", "authorized_keys"))
+	viper.SetDefault("logs.maxSize", 0)
+	viper.SetDefault("logs.compress", true)
+	viper.SetDefault("logs.newRooms", false)
+	viper.SetDefault("telnet.compress", true)
 	err = viper.ReadInConfig()
 	if err != nil {
 		log.Fatalf("Cannot read configuration: %s\n", err)
@@ -44,17 +84,138 @@ func main() {
 		log.Fatalf("Error reading motd from file. If you don't want a message of the day, create an empty file: %s\n", err)
 	}
 
+	accountStore, err := chatsrv.NewFileAccountStore(os.ExpandEnv(viper.GetString("accountsFile")))
+	if err != nil {
+		log.Fatalf("Error loading accounts: %s\n", err)
+	}
+
+	sendQueuePolicy, err := chatsrv.ParseSendQueuePolicy(viper.GetString("chat.sendQueuePolicy"))
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+
+	allowedNetworks, deniedNetworks, err := readNetworks()
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+
 	config := &chatsrv.ServerConfig{
-		BindAddr:            viper.GetString("bindAddr"),
-		ServerName:          viper.GetString("serverName"),
-		Motd:                string(motd),
-		UseTls:              viper.GetBool("tls.useTls"),
-		CertFile:            os.ExpandEnv(viper.GetString("tls.certFile")),
-		KeyFile:             os.ExpandEnv(viper.GetString("tls.keyFile")),
-		MessageLineLimit:    viper.GetInt("chat.messageLineLimit"),
-		MessagePasteTimeout: viper.GetDuration("chat.messagePasteTimeout") * time.Millisecond,
+		BindAddr:                 viper.GetString("bindAddr"),
+		WebBindAddr:              viper.GetString("webBindAddr"),
+		IRCBindAddr:              viper.GetString("ircBindAddr"),
+		ServerName:               viper.GetString("serverName"),
+		Motd:                     string(motd),
+		UseTls:                   viper.GetBool("tls.useTls"),
+		CertFile:                 os.ExpandEnv(viper.GetString("tls.certFile")),
+		KeyFile:                  os.ExpandEnv(viper.GetString("tls.keyFile")),
+		MessageLineLimit:         viper.GetInt("chat.messageLineLimit"),
+		MessagePasteTimeout:      viper.GetDuration("chat.messagePasteTimeout") * time.Millisecond,
+		ShutdownMessage:          viper.GetString("shutdownMessage"),
+		TopicHistorySize:         viper.GetInt("chat.topicHistorySize"),
+		HistorySize:              viper.GetInt("chat.historySize"),
+		HistoryReplayLines:       viper.GetInt("chat.historyReplayLines"),
+		SendQueueMaxMessages:     viper.GetInt("chat.sendQueueMaxMessages"),
+		SendQueueMaxBytes:        viper.GetInt("chat.sendQueueMaxBytes"),
+		SendQueuePolicy:          sendQueuePolicy,
+		SSHBindAddr:              viper.GetString("ssh.bindAddr"),
+		SSHHostKeyFile:           os.ExpandEnv(viper.GetString("ssh.hostKeyFile")),
+		SSHAuthorizedKeysFile:    os.ExpandEnv(viper.GetString("ssh.authorizedKeysFile")),
+		AccountStore:             accountStore,
+		RoomsFile:                os.ExpandEnv(viper.GetString("roomsFile")),
+		PersistentRooms:          viper.GetStringSlice("rooms.permanent"),
+		LogDir:                   os.ExpandEnv(viper.GetString("logs.dir")),
+		LogMaxSize:               viper.GetInt64("logs.maxSize"),
+		LogCompress:              viper.GetBool("logs.compress"),
+		LogNewRooms:              viper.GetBool("logs.newRooms"),
+		TelnetCompression:        viper.GetBool("telnet.compress"),
+		FloodMessageBurst:        viper.GetInt("chat.floodMessageBurst"),
+		FloodMessageRefill:       viper.GetDuration("chat.floodMessageRefill") * time.Millisecond,
+		FloodCommandBurst:        viper.GetInt("chat.floodCommandBurst"),
+		FloodCommandRefill:       viper.GetDuration("chat.floodCommandRefill") * time.Millisecond,
+		FloodNickBurst:           viper.GetInt("chat.floodNickBurst"),
+		FloodNickRefill:          viper.GetDuration("chat.floodNickRefill") * time.Second,
+		FloodThrottleDuration:    viper.GetDuration("chat.floodThrottleDuration") * time.Second,
+		FloodMuteDuration:        viper.GetDuration("chat.floodMuteDuration") * time.Second,
+		FloodResetAfter:          viper.GetDuration("chat.floodResetAfter") * time.Second,
+		AutoAwayAfter:            viper.GetDuration("chat.autoAwayAfter") * time.Second,
+		MaxConnectionsPerIP:      viper.GetInt("connections.maxPerIP"),
+		MaxConnectionsPerNetwork: viper.GetInt("connections.maxPerNetwork"),
+		ConnectionRateBurst:      viper.GetInt("connections.rateBurst"),
+		ConnectionRateRefill:     viper.GetDuration("connections.rateRefill") * time.Second,
+		AllowedNetworks:          allowedNetworks,
+		DeniedNetworks:           deniedNetworks,
+		DNSWorkers:               viper.GetInt("dns.workers"),
+		DNSTimeout:               viper.GetDuration("dns.timeout") * time.Second,
+		DNSCacheSize:             viper.GetInt("dns.cacheSize"),
+		DNSCacheTTL:              viper.GetDuration("dns.cacheTTL") * time.Second,
+		OperatorAccounts:         viper.GetStringSlice("operators.accounts"),
+		Operators:                viper.GetStringMapString("operators.passwords"),
+		AuditLogFile:             os.ExpandEnv(viper.GetString("audit.file")),
+		AuditLogMaxSize:          viper.GetInt64("audit.maxSize"),
+		BansFile:                 os.ExpandEnv(viper.GetString("bansFile")),
 	}
 
 	server := chatsrv.NewServer(config)
-	server.Start()
+	if err := server.LoadRooms(); err != nil {
+		log.Fatalf("Error loading rooms: %s\n", err)
+	}
+	if err := server.LoadBans(); err != nil {
+		log.Fatalf("Error loading bans: %s\n", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	stopped := make(chan struct{})
+	go func() {
+		server.Start()
+		close(stopped)
+	}()
+
+	for running := true; running; {
+		select {
+		case <-stopped:
+			// The server couldn't start
+			os.Exit(1)
+		case sig := <-signals:
+			log.Printf("Received %s\n", sig)
+			if sig != syscall.SIGHUP {
+				running = false
+				continue
+			}
+
+			// Reload the allowed and denied networks
+			if err := viper.ReadInConfig(); err != nil {
+				log.Printf("Cannot reload configuration: %s\n", err)
+				continue
+			}
+			allowedNetworks, deniedNetworks, err := readNetworks()
+			if err != nil {
+				log.Printf("Cannot reload networks: %s\n", err)
+				continue
+			}
+			server.SetNetworks(allowedNetworks, deniedNetworks)
+			log.Printf("Reloaded allowed and denied networks\n")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdownTimeout")*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down: %s\n", err)
+	}
+}
+
+// readNetworks reads the networks that are allowed and denied from the configuration
+func readNetworks() ([]*net.IPNet, []*net.IPNet, error) {
+	allowed, err := chatsrv.ParseNetworks(viper.GetStringSlice("connections.allow"))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error reading allowed networks")
+	}
+	denied, err := chatsrv.ParseNetworks(viper.GetStringSlice("connections.deny"))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error reading denied networks")
+	}
+
+	return allowed, denied, nil
 }
@@ -7,6 +7,7 @@ import (
 	"time"
 	"unicode"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/google/shlex"
 )
 
@@ -21,25 +22,33 @@ type defaultClientHandler struct {
 type initServerClientHandler defaultClientHandler
 
 func (ch initServerClientHandler) Handle(client *Client) string {
-	exitReason := idClientHandler{ch.server}.Handle(client)
-	if client.Stopped() || exitReason != "" {
-		return exitReason
+	// Clients who were already identified, such as by their SSH key, don't need to be asked
+	if !client.VarExists("nick") {
+		exitReason := idClientHandler{ch.server}.Handle(client)
+		if client.Stopped() || exitReason != "" {
+			return exitReason
+		}
 	}
 
 	return chatClientHandler{ch.server}.Handle(client)
 }
 
 // idClientHandler asks the client for a nick.
-// If none is provided, or the nick is invalid, it will  return  the reason.
+// If the nick is registered, it also asks for the account's password.
+// If none is provided, the nick is invalid, or the password is wrong, it will  return  the reason.
 // Otherwise, it sets "nick" on the client's Context and returns "".
+// Clients who logged into an account also get "account" set to the account's nick.
 type idClientHandler defaultClientHandler
 
+// Number of times a user can get their password wrong before being disconnected
+const maxPasswordAttempts = 3
+
 func (ch idClientHandler) Handle(client *Client) string {
-	client.Send <- []byte(fmt.Sprintf("%s\nNick: ", ch.server.config.ServerName))
+	client.Send <- append([]byte(fmt.Sprintf("%s\nNick: ", ch.server.config.ServerName)), telnetPromptEnd(client)...)
 
-	data, ok := <-client.Recv
-	if !ok {
-		return "Interrupted"
+	data, exitReason := ch.readLine(client)
+	if exitReason != "" {
+		return exitReason
 	}
 
 	nick := string(data)
@@ -49,10 +58,22 @@ func (ch idClientHandler) Handle(client *Client) string {
 		return "No nick provided"
 	}
 
-	for _, r := range nick {
-		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
-			client.Send <- []byte("Invalid nick; must contain only letters or numbers\n")
-			return "Nick must contain only letters or numbers"
+	if !isValidNick(nick) {
+		client.Send <- []byte("Invalid nick; must contain only letters or numbers\n")
+		return "Nick must contain only letters or numbers"
+	}
+
+	if store := ch.server.config.AccountStore; store != nil {
+		account, err := store.Account(nick)
+		if err == nil {
+			if exitReason := ch.authenticate(client, account); exitReason != "" {
+				return exitReason
+			}
+			nick = account.Nick // Use the case the nick was registered with
+		} else if err != ErrNoAccount {
+			log.Printf("Error looking up account for %s: %s\n", nick, err)
+			client.Send <- []byte("Cannot check if that nick is registered; try again later\n")
+			return "Error looking up account"
 		}
 	}
 
@@ -61,9 +82,80 @@ func (ch idClientHandler) Handle(client *Client) string {
 	return ""
 }
 
+// authenticate asks for an account's password.
+// Returns "" if the client got it right, or the reason they'll be disconnected.
+func (ch idClientHandler) authenticate(client *Client, account *Account) string {
+	for attempt := 0; attempt < maxPasswordAttempts; attempt++ {
+		if speaksTelnet(client) {
+			// Ask the client not to echo the password while it is being typed
+			prompt := append(append([]byte{}, telnetEchoOff...), []byte("Password: ")...)
+			client.Send <- append(prompt, telnetPromptEnd(client)...)
+		} else {
+			client.Send <- []byte("Password: ")
+		}
+		data, exitReason := ch.readLine(client)
+		if exitReason != "" {
+			return exitReason
+		}
+		if speaksTelnet(client) {
+			client.Send <- append(append([]byte{}, telnetEchoOn...), '\n')
+		}
+
+		if account.CheckPassword(string(data)) {
+			client.SetVar("account", account.Nick)
+			return ""
+		}
+
+		ch.server.auditLogger.log(auditEntry{Action: "password-failed", Nick: account.Nick, Host: describeHost(client), Details: "Wrong password for account"})
+		client.Send <- []byte("Wrong password.\n")
+	}
+
+	return "Wrong password"
+}
+
+// readLine waits for the client to send a line.
+// Returns the line, or the reason the client should be disconnected instead.
+func (ch idClientHandler) readLine(client *Client) ([]byte, string) {
+	select {
+	case data, ok := <-client.Recv:
+		if !ok {
+			return nil, "Interrupted"
+		}
+		return data, ""
+	case <-ch.server.quit:
+		client.Send <- []byte(ch.server.farewell())
+		return nil, "Server shutting down"
+	}
+}
+
 // chatClientHandler connects the client to the chat service
 type chatClientHandler defaultClientHandler
 
+// startSendQueue makes the channel the server sends a client's events on.
+// Events are moved into a send queue as soon as they arrive,
+// so a client that isn't reading can never hang the chat server.
+// This keeps draining the channel until the server closes it, even after the client is gone.
+func startSendQueue(server *server, client *Client) (chan *event, *sendQueue) {
+	responseChan := make(chan *event)
+	config := server.config
+	queue := newSendQueue(config.SendQueueMaxMessages, config.SendQueueMaxBytes, config.SendQueuePolicy)
+	client.SetVar("send_queue", queue)
+	go func() {
+		for ev := range responseChan {
+			if queue.push(ev) {
+				// Interrupt any write blocked on this client, so the handler can notice the overflow.
+				client.Abort(sendQueueOverflowReason)
+			}
+		}
+		queue.close()
+	}()
+
+	return responseChan, queue
+}
+
+// Reason given when a client is disconnected because their send queue filled up
+const sendQueueOverflowReason = "Send queue overflow"
+
 func (ch chatClientHandler) Handle(client *Client) string {
 	// Add the user to the chat server
 	nick, ok := client.GetVar("nick").(string)
@@ -74,14 +166,7 @@ func (ch chatClientHandler) Handle(client *Client) string {
 	// Responses will be piped from responseChan to client.Send.
 	// This is safer than giving the server client.Send, since checks for client.Stopped() can be done here,
 	// and the server doesn't have to worry about sending to a closed channel.
-	responseChan := make(chan []byte)
-	// If the client disconnects before the server is done sending to responseChan,
-	// the channel could fill up, which would hang the chat server.
-	// Make sure it is empty
-	defer func() {
-		for _ = range responseChan {
-		}
-	}()
+	responseChan, queue := startSendQueue(ch.server, client)
 
 	// Add this client as a user on the server
 	ch.server.in <- &serverCommand{
@@ -96,7 +181,8 @@ func (ch chatClientHandler) Handle(client *Client) string {
 	// Warning: In the name of efficiency, the message slice will not be cleared after each send.
 	// Only send message[:messageLineNumber], not the entire slice!
 	message := make([]string, ch.server.config.MessageLineLimit)
-	messageLineNumber := 0 // Lines start at 0; reset when message is sent.
+	messageLineNumber := 0   // Lines start at 0; reset when message is sent.
+	var target messageTarget // Where the message will be sent; reset when message is sent.
 	messagePasteTimeout := ch.server.config.MessagePasteTimeout
 
 	// Get a timer, but stop it right away, since we don't need it until the user starts sending messages to the room
@@ -112,25 +198,40 @@ func (ch chatClientHandler) Handle(client *Client) string {
 			return "Invalid nick"
 		}
 		select {
-		case data, ok := <-responseChan:
-			if !ok {
-				// Server closes responseChan to kic a client
-				client.Send <- []byte("Goodbye\n")
-				return "Disconnected by server"
+		case <-queue.ready:
+			items, overflowed, closed := queue.pop()
+			for _, ev := range items {
+				sendEvent(client, ev)
 			}
 
-			// Sanitize output, replacing 0xFF with 0xFFFF.
-			// 0xFF is the telnet IAC. Repeating twice escapes it.
-			// Prevents users from messing with telnet clients.
-			data = bytes.Replace(data, []byte{0xff}, []byte{0xff, 0xff}, -1)
-			client.Send <- data
+			if overflowed {
+				ch.server.in <- &serverCommand{
+					nick:         nick,
+					client:       client,
+					responseChan: responseChan,
+					command:      "rmuser",
+					args:         []string{sendQueueOverflowReason},
+				}
+
+				return sendQueueOverflowReason
+			}
+			if closed {
+				// Server closes responseChan to kick a client
+				sendEvent(client, reply("Goodbye\n"))
+				return "Disconnected by server"
+			}
 		case data, ok := <-client.Recv:
 			if !ok {
+				var reason []string
+				if client.StoppedReason() == sendQueueOverflowReason {
+					reason = append(reason, sendQueueOverflowReason)
+				}
 				ch.server.in <- &serverCommand{
 					nick:         nick,
 					client:       client,
 					responseChan: responseChan,
 					command:      "rmuser",
+					args:         reason,
 				}
 
 				return "User disconnected"
@@ -144,21 +245,58 @@ func (ch chatClientHandler) Handle(client *Client) string {
 
 				return rune(-1)
 			}, string(data))
-			if strings.HasPrefix(input, "/") {
+			if usesJSON(client) {
+				jsonCommand, err := parseJSONCommand(input)
+				if err != nil {
+					sendEvent(client, errorReply(fmt.Sprintf("%s\n", err)))
+					continue
+				}
+
+				if jsonCommand.Command == "say" {
+					if len(jsonCommand.Args) > len(message) {
+						sendEvent(client, errorReply(fmt.Sprintf("Messages can have at most %d lines.\n", len(message))))
+						continue
+					}
+					sendMessage(ch.server, nick, client, responseChan, messageTarget{}, jsonCommand.Args)
+					continue
+				}
+
+				ch.server.in <- &serverCommand{
+					nick:          nick,
+					client:        client,
+					responseChan:  responseChan,
+					command:       jsonCommand.Command,
+					args:          jsonCommand.Args,
+					userInitiated: true,
+				}
+			} else if strings.HasPrefix(input, "/") {
 				// This is a command
 				// Stop the message timeout timer, until it is needed again.
 				stopTimerSafely(messagePasteTimer)
 				// Before executing this command,
 				// send the message, if there is one waiting to be sent.
-				sendMessage(ch.server, nick, client, responseChan, message[:messageLineNumber])
+				sendMessage(ch.server, nick, client, responseChan, target, message[:messageLineNumber])
 				messageLineNumber = 0
+				target = messageTarget{}
+
+				// Private messages are collected like messages to a room,
+				// so text pasted right after /msg is sent along with it.
+				if newTarget, text, ok := parsePrivateMessage(input); ok {
+					target = newTarget
+					message[messageLineNumber] = text
+					messageLineNumber++
+					messagePasteTimer.Reset(messagePasteTimeout)
+					continue
+				}
+
 				args, err := shlex.Split(input)
 				if err != nil {
-					client.Send <- []byte("Error\n")
+					sendEvent(client, errorReply(fmt.Sprintf("Error reading command: %s\nUse quotes around arguments with spaces or apostrophes, like /topic \"Bob's room\"\n", err)))
+					continue
 				}
 
 				if len(args) < 1 {
-					client.Send <- []byte("No command specified\n")
+					sendEvent(client, errorReply("No command specified\n"))
 					continue
 				}
 				commandName := strings.TrimPrefix(args[0], "/")
@@ -185,7 +323,7 @@ func (ch chatClientHandler) Handle(client *Client) string {
 				} else {
 					// No more lines allowed in message.
 					// Send what's there and start another message.
-					sendMessage(ch.server, nick, client, responseChan, message[:messageLineNumber])
+					sendMessage(ch.server, nick, client, responseChan, target, message[:messageLineNumber])
 					messageLineNumber = 0
 					message[messageLineNumber] = input
 					messageLineNumber++
@@ -193,8 +331,9 @@ func (ch chatClientHandler) Handle(client *Client) string {
 			}
 		case <-messagePasteTimer.C:
 			// The message paste timeout was exceeded; send the message to the server
-			sendMessage(ch.server, nick, client, responseChan, message[:messageLineNumber])
+			sendMessage(ch.server, nick, client, responseChan, target, message[:messageLineNumber])
 			messageLineNumber = 0
+			target = messageTarget{}
 		}
 	}
 
@@ -203,20 +342,76 @@ func (ch chatClientHandler) Handle(client *Client) string {
 
 // Helper functions
 
-// sendMessage sends a message to be sent to a room on the server.
+// messageTarget says where a message should be sent.
+// The zero value sends it to the user's active room.
+type messageTarget struct {
+	command string   // Command to send the message with, such as msg; "" says it in the active room
+	args    []string // Arguments that come before the message, such as the recipient's nick
+}
+
+// parsePrivateMessage checks if input is a /msg or /reply command with a message.
+// If it is, it returns where the message should go, and the first line of the message.
+// Without a message, the command is sent as usual so the server can explain how to use it.
+func parsePrivateMessage(input string) (messageTarget, string, bool) {
+	commandName, rest := splitFirstWord(strings.TrimPrefix(input, "/"))
+	switch commandName {
+	case "msg":
+		recipient, text := splitFirstWord(rest)
+		if text == "" {
+			return messageTarget{}, "", false
+		}
+		return messageTarget{command: "msg", args: []string{recipient}}, text, true
+	case "reply":
+		if rest == "" {
+			return messageTarget{}, "", false
+		}
+		return messageTarget{command: "reply"}, rest, true
+	}
+
+	return messageTarget{}, "", false
+}
+
+// splitFirstWord splits s into the first word, and whatever follows it.
+// Leading and trailing spaces are removed from both.
+func splitFirstWord(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+// sendMessage sends a message to be sent to a room, or to whoever target specifies, on the server.
 // Only runes which unicode.IsGraphic returns true for will be included.
-func sendMessage(server *server, nick string, client *Client, responseChan chan<- []byte, message []string) {
+func sendMessage(server *server, nick string, client *Client, responseChan chan<- *event, target messageTarget, message []string) {
 	if len(message) == 0 {
 		// Nothing to send
 		return
 	}
+
+	fullMessage := strings.Join(message, "\n")
+	if target.command != "" {
+		args := make([]string, 0, len(target.args)+1)
+		args = append(args, target.args...)
+		server.in <- &serverCommand{
+			nick:          nick,
+			client:        client,
+			responseChan:  responseChan,
+			command:       target.command,
+			args:          append(args, fullMessage),
+			userInitiated: true,
+		}
+		return
+	}
+
 	roomName, ok := server.userActiveRoom[nick]
 	if !ok {
-		client.Send <- []byte("You'll need to join a room before you can talk.\n/users lists all users, /rooms lists rooms, /join room joins a room,\n/leave leaves the room.\n")
+		sendEvent(client, errorReply("You'll need to join a room before you can talk.\n/users lists all users, /rooms lists rooms, /join room joins a room,\n/leave leaves the room.\n"))
 		return
 	}
 
-	fullMessage := strings.Join(message, "\n")
 	server.in <- &serverCommand{
 		nick:         nick,
 		client:       client,
@@ -226,6 +421,22 @@ func sendMessage(server *server, nick string, client *Client, responseChan chan<
 	}
 }
 
+// sendEvent writes an event to a line-based client, in the protocol it is using.
+// MUD clients also get it as GMCP, if they asked for it.
+func sendEvent(client *Client, ev *event) {
+	if data := formatEvent(client, ev); data != nil {
+		if speaksTelnet(client) {
+			// Sanitize output, replacing 0xFF with 0xFFFF.
+			// 0xFF is the telnet IAC. Repeating twice escapes it.
+			// Prevents users from messing with telnet clients.
+			data = bytes.Replace(data, []byte{0xff}, []byte{0xff, 0xff}, -1)
+		}
+		client.Send <- data
+	}
+
+	sendGMCP(client, ev)
+}
+
 // stopTimerSafely stops a timer and drains it's channel
 // in case it expired before it was stopped
 func stopTimerSafely(timer *time.Timer) {
@@ -37,6 +37,7 @@ type Client struct {
 	contextRWLock sync.RWMutex           // protects context
 	context       map[string]interface{} // Arbetrary information can be stored here
 	done          chan struct{}          // Closed when client is finished
+	finished      chan struct{}          // Closed when all output has been written, and rw is closed
 	stoppedLock   sync.Mutex             // protects stopped
 	stopped       bool                   // True if client has been stopped
 	stoppedReason string                 // Reason the client was stopped
@@ -52,13 +53,14 @@ func NewClient(rw io.ReadWriteCloser, inputMode InputMode, clientHandler ClientH
 		return nil, errors.Wrap(err, "Cannot get UUID")
 	}
 	client := &Client{
-		rw:      rw,
-		scanner: bufio.NewScanner(rw),
-		Send:    make(chan []byte, SendBuffSize),
-		Recv:    make(chan []byte),
-		uuid:    u,
-		context: make(map[string]interface{}),
-		done:    make(chan struct{}, 1),
+		rw:       rw,
+		scanner:  bufio.NewScanner(rw),
+		Send:     make(chan []byte, SendBuffSize),
+		Recv:     make(chan []byte),
+		uuid:     u,
+		context:  make(map[string]interface{}),
+		done:     make(chan struct{}, 1),
+		finished: make(chan struct{}),
 	}
 
 	err = client.SetInputMode(inputMode)
@@ -79,6 +81,7 @@ func NewClient(rw io.ReadWriteCloser, inputMode InputMode, clientHandler ClientH
 func (client *Client) send() {
 	// This method needs to close client.rw when the client is stopped.
 	// It takes responsibility for this to prevent writing to rw when it is closed (by someone else).
+	defer close(client.finished)
 	defer client.rw.Close()
 	defer func() {
 		if r := recover(); r != nil {
@@ -88,14 +91,23 @@ func (client *Client) send() {
 	}()
 	log.Printf("Starting pipe from client handler to %s\n", client)
 
+	failed := false
 	for data := range client.Send {
+		if failed {
+			// Keep draining client.Send, so client handlers don't block on a dead client.
+			continue
+		}
+
 		// Keep sending till data is empty, or there is an error
 		for len(data) > 0 {
 			n, err := client.rw.Write(data)
 			if err != nil {
-				log.Printf("Error sending data to client %s: %s\n", client, err)
+				if !client.Stopped() {
+					log.Printf("Error sending data to client %s: %s\n", client, err)
+				}
 				client.Stop("Send error")
-				return
+				failed = true
+				break
 			}
 
 			if n > len(data) {
@@ -219,6 +231,21 @@ func (client *Client) Stop(reason string) {
 	client.stopped = true
 }
 
+// Finished returns a channel that is closed once the client's send pipe has stopped;
+// everything sent on client.Send has been written, and the ReadWriteCloser is closed.
+func (client *Client) Finished() <-chan struct{} {
+	return client.finished
+}
+
+// Abort stops the client, and closes its ReadWriteCloser right away,
+// rather than waiting for the initial ClientHandler to return.
+// This interrupts a write that is blocked on a peer who has stopped reading.
+// Anything still waiting to be sent is discarded.
+func (client *Client) Abort(reason string) {
+	client.Stop(reason)
+	client.rw.Close()
+}
+
 func (client *Client) Uuid() uuid.UUID {
 	return client.uuid
 }
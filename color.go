@@ -0,0 +1,218 @@
+package chatsrv
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// theme says how text is styled for users with colors on.
+// Styles are ANSI SGR parameters, such as "1;31" for bold red.
+type theme struct {
+	nicks   []string // Nicks get one of these, picked by a hash of the nick, so each nick always looks the same
+	system  string   // Things the server says happened, such as joins and topic changes
+	action  string   // /me
+	mention string   // Messages that mention the user's nick
+	private string   // Private messages
+	error   string   // Errors
+}
+
+// Theme used until users pick one
+const defaultTheme = "default"
+
+var themes = map[string]*theme{
+	"default": {
+		nicks:   []string{"31", "32", "33", "34", "35", "36", "91", "92", "93", "94", "95", "96"},
+		system:  "90",
+		action:  "35",
+		mention: "1;33",
+		private: "36",
+		error:   "31",
+	},
+	"light": {
+		// Darker colors, for terminals with light backgrounds
+		nicks:   []string{"31", "32", "34", "35", "36", "38;5;130", "38;5;22", "38;5;54"},
+		system:  "38;5;242",
+		action:  "38;5;90",
+		mention: "1;38;5;124",
+		private: "38;5;24",
+		error:   "1;31",
+	},
+	"pastel": {
+		nicks:   []string{"38;5;217", "38;5;223", "38;5;157", "38;5;159", "38;5;183", "38;5;225", "38;5;194", "38;5;153"},
+		system:  "38;5;246",
+		action:  "38;5;182",
+		mention: "1;38;5;229",
+		private: "38;5;152",
+		error:   "38;5;210",
+	},
+	"mono": {
+		// No colors, for terminals that only do bold and underline
+		nicks:   []string{"1"},
+		system:  "2",
+		action:  "3",
+		mention: "1;4",
+		private: "4",
+		error:   "1",
+	},
+}
+
+// useColor returns true if text sent to the client should be styled.
+// Users can turn colors on or off with /color; until they do,
+// colors are on for clients that said what kind of terminal they have.
+// They are always off for dumb terminals, and in screen reader mode.
+func useColor(client *Client) bool {
+	terminalType, _ := client.GetVar("terminal_type").(string)
+	if isDumbTerminal(terminalType) || screenReader(client) {
+		return false
+	}
+	if color, ok := client.GetVar("color").(bool); ok {
+		return color
+	}
+
+	return terminalType != ""
+}
+
+// isDumbTerminal returns true if a terminal type says the terminal can't show colors
+func isDumbTerminal(terminalType string) bool {
+	switch strings.ToLower(terminalType) {
+	case "dumb", "unknown", "network":
+		return true
+	}
+
+	return false
+}
+
+// clientTheme gets the theme the client picked
+func clientTheme(client *Client) *theme {
+	name, _ := client.GetVar("theme").(string)
+	if t, ok := themes[name]; ok {
+		return t
+	}
+
+	return themes[defaultTheme]
+}
+
+// styleEvent gets the text of an event for a client, styled with the client's theme
+func styleEvent(client *Client, ev *event) string {
+	t := clientTheme(client)
+	switch ev.Type {
+	case eventMessage:
+		if !strings.HasPrefix(ev.Text, ev.From) {
+			return ev.Text
+		}
+		rest := ev.Text[len(ev.From):]
+		if nick, _ := client.GetVar("nick").(string); ev.From != nick && mentions(ev.Body, nick) {
+			rest = styleLines(t.mention, rest)
+		}
+		return styleLines(t.nickStyle(ev.From), ev.From) + rest
+	case eventAction:
+		return styleLines(t.action, ev.Text)
+	case eventPrivate:
+		return styleLines(t.private, ev.Text)
+	case eventNotice, eventJoin, eventLeave, eventNick, eventTopic:
+		return styleLines(t.system, ev.Text)
+	case eventError:
+		return styleLines(t.error, ev.Text)
+	}
+
+	return ev.Text
+}
+
+// nickStyle gets the style of a nick
+func (t *theme) nickStyle(nick string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(strings.ToLower(nick)))
+	return t.nicks[hash.Sum32()%uint32(len(t.nicks))]
+}
+
+// styleLines styles each line of text.
+// The style is reset at the end of each line, so it can't bleed into whatever comes next.
+func styleLines(style, text string) string {
+	if style == "" {
+		return text
+	}
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = fmt.Sprintf("\x1b[%sm%s\x1b[0m", style, line)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// mentions returns true if text has nick in it, as a word of its own
+func mentions(text, nick string) bool {
+	if nick == "" {
+		return false
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if word == strings.ToLower(nick) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cmdColor turns colors on or off
+var cmdColor commandHandlerFunc = func(server *server, command *serverCommand) {
+	if len(command.args) < 1 || (command.args[0] != "on" && command.args[0] != "off") {
+		command.responseChan <- errorReply("Use /color on|off\n/theme picks how things are colored.\n")
+		return
+	}
+
+	color := command.args[0] == "on"
+	if transport, _ := command.client.GetVar("transport").(string); color && (transport == "websocket" || transport == "irc") {
+		command.responseChan <- errorReply("Your client can't show colors.\n")
+		return
+	}
+	if terminalType, _ := command.client.GetVar("terminal_type").(string); color && isDumbTerminal(terminalType) {
+		command.responseChan <- errorReply(fmt.Sprintf("Your terminal (%s) can't show colors.\n", terminalType))
+		return
+	}
+
+	command.client.SetVar("color", color)
+	savePreferences(server, command)
+	command.responseChan <- reply(fmt.Sprintf("Colors are now %s.\n", command.args[0]))
+}
+
+// cmdTheme lists the themes, or picks one
+var cmdTheme commandHandlerFunc = func(server *server, command *serverCommand) {
+	if len(command.args) < 1 {
+		current, _ := command.client.GetVar("theme").(string)
+		if _, ok := themes[current]; !ok {
+			current = defaultTheme
+		}
+
+		names := make([]string, 0, len(themes))
+		for name := range themes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		command.responseChan <- reply(fmt.Sprintf("Themes: %s\nYou are using %s. Use /theme <name> to pick another.\n", strings.Join(names, ", "), current))
+		return
+	}
+
+	name := strings.ToLower(command.args[0])
+	if _, ok := themes[name]; !ok {
+		command.responseChan <- errorReply("There is no theme by that name; /theme lists them.\n")
+		return
+	}
+
+	command.client.SetVar("theme", name)
+	savePreferences(server, command)
+	response := fmt.Sprintf("Now using the %s theme.\n", name)
+	if !useColor(command.client) {
+		response += "Colors are off; /color on turns them on.\n"
+	}
+	command.responseChan <- reply(response)
+}
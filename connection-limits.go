@@ -0,0 +1,208 @@
+package chatsrv
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// How often buckets of addresses that stopped connecting are thrown away
+const connectionSweepInterval = time.Minute
+
+// connectionLimiter decides who can connect.
+// Addresses can be allowed or denied by network, and each address and network can only have so many connections open.
+// Each address can also only connect so often, limited by a token bucket.
+type connectionLimiter struct {
+	perIP      int           // Connections each address can have open; 0 is unlimited
+	perNetwork int           // Connections each /24 (or /64 for IPv6) can have open; 0 is unlimited
+	rateBurst  int           // Connections each address can make at once, before having to wait for rateRefill; 0 is unlimited
+	rateRefill time.Duration // 0 is unlimited
+
+	lock      sync.Mutex // protects everything below
+	allowed   []*net.IPNet
+	denied    []*net.IPNet
+	ips       map[string]int // Connections open, by address
+	networks  map[string]int // Connections open, by network
+	rates     map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newConnectionLimiter(config *ServerConfig) *connectionLimiter {
+	return &connectionLimiter{
+		perIP:      config.MaxConnectionsPerIP,
+		perNetwork: config.MaxConnectionsPerNetwork,
+		rateBurst:  config.ConnectionRateBurst,
+		rateRefill: config.ConnectionRateRefill,
+		allowed:    config.AllowedNetworks,
+		denied:     config.DeniedNetworks,
+		ips:        make(map[string]int),
+		networks:   make(map[string]int),
+		rates:      make(map[string]*tokenBucket),
+	}
+}
+
+// ParseNetworks parses a list of networks in CIDR notation, such as "192.0.2.0/24" or "2001:db8::/32".
+// Plain addresses are taken as networks of their own.
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid address or network: %s", s)
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid network")
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// SetNetworks replaces the networks that are allowed and denied, such as after the configuration is reloaded.
+// If allowed isn't empty, only addresses in it can connect; addresses in denied can never connect.
+// Users who are already connected stay connected.
+func (server *server) SetNetworks(allowed, denied []*net.IPNet) {
+	limiter := server.connectionLimiter
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.allowed = allowed
+	limiter.denied = denied
+}
+
+// admit checks if a client from addr can connect.
+// If it can, the connection is counted until release is called, and "" is returned.
+// Otherwise, the reason it can't is returned.
+func (l *connectionLimiter) admit(addr string) string {
+	ip := net.ParseIP(addr)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if ip != nil {
+		if len(l.allowed) > 0 && !containsIP(l.allowed, ip) {
+			return "Your address isn't allowed to connect."
+		}
+		if containsIP(l.denied, ip) {
+			return "Your address isn't allowed to connect."
+		}
+	}
+
+	// The caps are checked first, so connections they refuse don't use up the address's rate budget
+	network := networkOf(ip, addr)
+	if l.perIP > 0 && l.ips[addr] >= l.perIP {
+		return "Too many connections from your address."
+	}
+	if l.perNetwork > 0 && l.networks[network] >= l.perNetwork {
+		return "Too many connections from your network."
+	}
+
+	now := time.Now()
+	if l.rateBurst > 0 && l.rateRefill > 0 {
+		l.sweep(now)
+		bucket, ok := l.rates[addr]
+		if !ok {
+			bucket = &tokenBucket{}
+			l.rates[addr] = bucket
+		}
+		if !bucket.take(l.rateBurst, l.rateRefill, now) {
+			return "You are connecting too often; try again later."
+		}
+	}
+
+	l.ips[addr]++
+	l.networks[network]++
+	return ""
+}
+
+// admitConnection checks if a client from remoteAddr can connect, the way connectionLimiter.admit does,
+// logging and auditing connections that are refused.
+// Returns "" if it can, or the reason it can't; the caller must refuse it in a way its transport understands.
+func (server *server) admitConnection(remoteAddr, transport string) string {
+	reason := server.connectionLimiter.admit(remoteAddr)
+	if reason != "" {
+		log.Printf("Refused connection from %s via %s: %s\n", remoteAddr, transport, reason)
+		server.auditLogger.log(auditEntry{Action: "connect-refused", Host: remoteAddr, Details: fmt.Sprintf("Via %s: %s", transport, reason)})
+	}
+
+	return reason
+}
+
+// release stops counting a connection from addr that admit let in
+func (l *connectionLimiter) release(addr string) {
+	network := networkOf(net.ParseIP(addr), addr)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.ips[addr]--; l.ips[addr] <= 0 {
+		delete(l.ips, addr)
+	}
+	if l.networks[network]--; l.networks[network] <= 0 {
+		delete(l.networks, network)
+	}
+}
+
+// sweep throws away the buckets of addresses that haven't connected in long enough for their buckets to fill up.
+// Must be called with l.lock held.
+func (l *connectionLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < connectionSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	full := time.Duration(l.rateBurst) * l.rateRefill
+	for addr, bucket := range l.rates {
+		if now.Sub(bucket.last) >= full {
+			delete(l.rates, addr)
+		}
+	}
+}
+
+// containsIP returns true if ip is in any of networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// networkOf gets the network an address is counted in: its /24 for IPv4, or its /64 for IPv6.
+// Addresses that aren't IPs, which shouldn't happen, are a network of their own.
+func networkOf(ip net.IP, addr string) string {
+	if ip == nil {
+		return addr
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%s/24", ip4.Mask(net.CIDRMask(24, 32)))
+	}
+
+	return fmt.Sprintf("%s/64", ip.Mask(net.CIDRMask(64, 128)))
+}
+
+// refuseConnection tells a client why it can't connect, in a way its transport understands, and disconnects it.
+func refuseConnection(rw io.ReadWriteCloser, transport, reason string) {
+	if transport == "irc" {
+		io.WriteString(rw, formatIRCMessage("", "ERROR", "Closing link: "+reason))
+	} else {
+		io.WriteString(rw, reason+"\n")
+	}
+	rw.Close()
+}
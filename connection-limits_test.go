@@ -0,0 +1,187 @@
+package chatsrv
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseNetworks(t *testing.T) {
+	tests := []struct {
+		list    []string
+		want    []string
+		wantErr bool
+	}{
+		{[]string{"192.0.2.0/24", "2001:db8::/32"}, []string{"192.0.2.0/24", "2001:db8::/32"}, false},
+		{[]string{" 198.51.100.7 "}, []string{"198.51.100.7/32"}, false},
+		{[]string{"2001:db8::1"}, []string{"2001:db8::1/128"}, false},
+		{[]string{"192.0.2.1/24"}, []string{"192.0.2.0/24"}, false},
+		{nil, []string{}, false},
+		{[]string{"example.com"}, nil, true},
+		{[]string{"192.0.2.0/33"}, nil, true},
+	}
+
+	for _, test := range tests {
+		networks, err := ParseNetworks(test.list)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseNetworks(%q) succeeded, want an error", test.list)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseNetworks(%q): %s", test.list, err)
+			continue
+		}
+		if len(networks) != len(test.want) {
+			t.Errorf("ParseNetworks(%q) = %v, want %v", test.list, networks, test.want)
+			continue
+		}
+		for i, network := range networks {
+			if network.String() != test.want[i] {
+				t.Errorf("ParseNetworks(%q)[%d] = %s, want %s", test.list, i, network, test.want[i])
+			}
+		}
+	}
+}
+
+func TestNetworkOf(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.0/24"},
+		{"192.0.2.254", "192.0.2.0/24"},
+		{"192.0.3.1", "192.0.3.0/24"},
+		{"::ffff:192.0.2.1", "192.0.2.0/24"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2::1", "2001:db8:1:2::/64"},
+		{"not an address", "not an address"},
+	}
+
+	for _, test := range tests {
+		if got := networkOf(net.ParseIP(test.addr), test.addr); got != test.want {
+			t.Errorf("networkOf(%s) = %s, want %s", test.addr, got, test.want)
+		}
+	}
+}
+
+// mustParseNetworks parses networks for tests, failing the test if any are invalid
+func mustParseNetworks(t *testing.T, list ...string) []*net.IPNet {
+	networks, err := ParseNetworks(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return networks
+}
+
+func TestConnectionLimiterNetworks(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		denied  []string
+		addr    string
+		want    bool
+	}{
+		{"no lists", nil, nil, "192.0.2.1", true},
+		{"allowed", []string{"192.0.2.0/24"}, nil, "192.0.2.1", true},
+		{"not allowed", []string{"192.0.2.0/24"}, nil, "198.51.100.1", false},
+		{"denied", nil, []string{"192.0.2.0/24"}, "192.0.2.1", false},
+		{"not denied", nil, []string{"192.0.2.0/24"}, "198.51.100.1", true},
+		{"deny wins over allow", []string{"192.0.2.0/24"}, []string{"192.0.2.7"}, "192.0.2.7", false},
+		{"allowed next to a denied address", []string{"192.0.2.0/24"}, []string{"192.0.2.7"}, "192.0.2.8", true},
+		{"IPv6", []string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newConnectionLimiter(&ServerConfig{
+				AllowedNetworks: mustParseNetworks(t, test.allowed...),
+				DeniedNetworks:  mustParseNetworks(t, test.denied...),
+			})
+			reason := limiter.admit(test.addr)
+			if got := reason == ""; got != test.want {
+				t.Errorf("admit(%s) = %q, want admitted: %v", test.addr, reason, test.want)
+			}
+		})
+	}
+}
+
+func TestConnectionLimiterCaps(t *testing.T) {
+	limiter := newConnectionLimiter(&ServerConfig{MaxConnectionsPerIP: 2, MaxConnectionsPerNetwork: 3})
+	admit := func(addr string, want bool) {
+		t.Helper()
+		reason := limiter.admit(addr)
+		if got := reason == ""; got != want {
+			t.Errorf("admit(%s) = %q, want admitted: %v", addr, reason, want)
+		}
+	}
+
+	admit("192.0.2.1", true)
+	admit("192.0.2.1", true)
+	admit("192.0.2.1", false) // Over the address's cap
+	admit("192.0.2.2", true)
+	admit("192.0.2.3", false) // Over the network's cap
+	admit("198.51.100.1", true)
+
+	limiter.release("192.0.2.1")
+	admit("192.0.2.3", true)
+	admit("192.0.2.3", false)
+	limiter.release("192.0.2.2")
+	limiter.release("192.0.2.3")
+	admit("192.0.2.1", true)
+
+	if len(limiter.ips) != 2 || limiter.ips["192.0.2.1"] != 2 || limiter.networks["192.0.2.0/24"] != 2 {
+		t.Errorf("after releasing, counted %v by address and %v by network", limiter.ips, limiter.networks)
+	}
+}
+
+func TestConnectionLimiterRate(t *testing.T) {
+	tests := []struct {
+		name   string
+		burst  int
+		refill time.Duration
+		tries  int
+		want   int
+	}{
+		{"under the burst", 3, time.Hour, 3, 3},
+		{"over the burst", 3, time.Hour, 5, 3},
+		{"burst of 0 is unlimited", 0, time.Hour, 20, 20},
+		{"refill of 0 is unlimited", 3, 0, 20, 20},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newConnectionLimiter(&ServerConfig{ConnectionRateBurst: test.burst, ConnectionRateRefill: test.refill})
+			got := 0
+			for i := 0; i < test.tries; i++ {
+				if limiter.admit("192.0.2.1") == "" {
+					got++
+					limiter.release("192.0.2.1")
+				}
+			}
+			if got != test.want {
+				t.Errorf("%d of %d connections were admitted, want %d", got, test.tries, test.want)
+			}
+		})
+	}
+}
+
+func TestConnectionLimiterCapsDontUseRate(t *testing.T) {
+	limiter := newConnectionLimiter(&ServerConfig{MaxConnectionsPerIP: 1, ConnectionRateBurst: 2, ConnectionRateRefill: time.Hour})
+	if reason := limiter.admit("192.0.2.1"); reason != "" {
+		t.Fatalf("first connection was refused: %s", reason)
+	}
+	for i := 0; i < 5; i++ {
+		if limiter.admit("192.0.2.1") == "" {
+			t.Fatal("connection over the address's cap was admitted")
+		}
+	}
+
+	// The refused connections must not have taken the last token
+	limiter.release("192.0.2.1")
+	if reason := limiter.admit("192.0.2.1"); reason != "" {
+		t.Errorf("connection after releasing was refused: %s", reason)
+	}
+}
@@ -0,0 +1,138 @@
+package chatsrv
+
+import (
+	"time"
+)
+
+// eventType says what an event is about
+type eventType string
+
+const (
+	eventReply   eventType = "reply"   // A response to a command, only in Text
+	eventError   eventType = "error"   // A command failed, or was used wrong; only in Text
+	eventWelcome eventType = "welcome" // The user was added to the server
+	eventMessage eventType = "message" // From said Body in Room
+	eventAction  eventType = "action"  // From did Body in Room, with /me
+	eventPrivate eventType = "private" // From sent Body to To in a private message
+	eventNotice  eventType = "notice"  // Something happened in Room, only described in Text
+	eventJoin    eventType = "join"    // From joined Room
+	eventJoined  eventType = "joined"  // The user joined Room; Data is a *roomInfo
+	eventLeave   eventType = "leave"   // From left Room; Body is the reason
+	eventNick    eventType = "nick"    // From is now known as To
+	eventTopic   eventType = "topic"   // From changed Room's topic to Body; "" removes it
+	eventUsers   eventType = "users"   // Reply to /users; Data is a []userInfo
+	eventRooms   eventType = "rooms"   // Reply to /rooms; Data is a []*roomInfo, without members
+	eventWhois   eventType = "whois"   // Reply to /whois; Data is a *whoisInfo
+	eventAudit   eventType = "audit"   // Reply to /audit; Data is a []auditEntry
+	eventBans    eventType = "bans"    // Reply to /bans, listing Room's bans; Data is a []banInfo
+	eventAway    eventType = "away"    // From is away, with Body as their away message; sent to them, and to users who message them
+	eventBack    eventType = "back"    // The user is no longer away
+)
+
+// event is something sent to a user: a response to one of their commands, or something that happened on the server.
+// Text is how the event is shown to users of line-based clients, such as telnet;
+// if it's "", they don't see the event at all.
+// Other clients can use the rest of the fields to show it however they like.
+// The same event can be sent to many users, so it must not be changed once sent.
+type event struct {
+	Type eventType   `json:"type"`
+	Time time.Time   `json:"time"`
+	Room string      `json:"room,omitempty"`
+	From string      `json:"from,omitempty"`
+	To   string      `json:"to,omitempty"`
+	Body string      `json:"body,omitempty"`
+	Text string      `json:"text,omitempty"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// reply makes an event that responds to a command with some text
+func reply(text string) *event {
+	return &event{Type: eventReply, Time: time.Now(), Text: text}
+}
+
+// errorReply makes an event that says why a command failed
+func errorReply(text string) *event {
+	return &event{Type: eventError, Time: time.Now(), Text: text}
+}
+
+// roomMember is someone in a room
+type roomMember struct {
+	Nick string `json:"nick"`
+	Mod  bool   `json:"mod"`
+}
+
+// roomInfo describes a room
+type roomInfo struct {
+	Name       string       `json:"name"`
+	Topic      string       `json:"topic"`
+	TopicSetBy string       `json:"topicSetBy,omitempty"`
+	TopicSetAt time.Time    `json:"topicSetAt"`
+	Private    bool         `json:"private"`
+	Permanent  bool         `json:"permanent"`
+	Logged     bool         `json:"logged"`
+	Size       int          `json:"size"`              // Number of members
+	Members    []roomMember `json:"members,omitempty"` // Only filled in for some events
+}
+
+// userInfo describes a user on the server
+type userInfo struct {
+	Nick     string    `json:"nick"`
+	Room     string    `json:"room,omitempty"`
+	Mod      bool      `json:"mod"` // They are a moderator of Room
+	LastSeen time.Time `json:"lastSeen"`
+	Away     string    `json:"away,omitempty"` // Their away message, if they are away
+}
+
+// banInfo describes a ban from a room
+type banInfo struct {
+	Nick        string    `json:"nick,omitempty"`        // "" if only banned by host
+	HostPattern string    `json:"hostPattern,omitempty"` // "" if only banned by nick
+	SetBy       string    `json:"setBy"`
+	Reason      string    `json:"reason,omitempty"`
+	Expires     time.Time `json:"expires"` // Zero if the ban never expires
+}
+
+// whoisInfo describes a user in more detail
+type whoisInfo struct {
+	Nick      string    `json:"nick"`
+	Host      string    `json:"host"`
+	Transport string    `json:"transport"`
+	Account   string    `json:"account,omitempty"`
+	Operator  bool      `json:"operator,omitempty"` // They are a server operator
+	Room      string    `json:"room,omitempty"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Away      string    `json:"away,omitempty"` // Their away message, if they are away
+	Dropped   int       `json:"dropped"`        // Messages dropped from their send queue
+	// What is known about the terminal of a telnet client
+	TerminalType string `json:"terminalType,omitempty"`
+	WindowWidth  int    `json:"windowWidth,omitempty"`
+	WindowHeight int    `json:"windowHeight,omitempty"`
+	// Bytes sent to a telnet client with MCCP2 compression on, before and after compressing them
+	UncompressedBytes int64 `json:"uncompressedBytes,omitempty"`
+	CompressedBytes   int64 `json:"compressedBytes,omitempty"`
+}
+
+// info describes the room.
+// If withMembers is true, everyone in the room is listed, moderators first.
+func (room *room) info(withMembers bool) *roomInfo {
+	info := &roomInfo{
+		Name:       room.name,
+		Topic:      room.topic.text,
+		TopicSetBy: room.topic.setBy,
+		TopicSetAt: room.topic.setAt,
+		Private:    room.roomPass != "",
+		Permanent:  room.persistent,
+		Logged:     room.logging,
+		Size:       len(room.mods) + len(room.users),
+	}
+	if withMembers {
+		for nick := range room.mods {
+			info.Members = append(info.Members, roomMember{Nick: nick, Mod: true})
+		}
+		for nick := range room.users {
+			info.Members = append(info.Members, roomMember{Nick: nick})
+		}
+	}
+
+	return info
+}
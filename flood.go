@@ -0,0 +1,186 @@
+package chatsrv
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Users who send too fast are stopped by token buckets, one for each kind of command.
+// A bucket holds up to a burst of tokens, and gets one back each refill interval;
+// each command takes one, and commands are dropped while the bucket is empty.
+// Users who keep running out are warned, then throttled, then muted, and finally disconnected.
+// Server operators are exempt.
+
+// Kinds of commands, each limited by a bucket of its own
+const (
+	floodMessages = iota // Things said to a room or another user
+	floodCommands        // Everything else users can type
+	floodNicks           // Nick changes
+	floodKinds
+)
+
+// Steps taken against a user who keeps flooding, one more each time they run out of tokens
+const (
+	floodWarned = iota + 1
+	floodThrottled
+	floodMuted
+	floodDisconnected
+)
+
+// Reason given when a client is disconnected for flooding
+const floodReason = "Flooding"
+
+// tokenBucket limits how fast something can be done
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // When tokens was last brought up to date
+}
+
+// take takes a token from the bucket, returning false if there isn't one.
+// The bucket holds up to burst tokens, and gets one back each refill.
+// A refill of 0 is unlimited, like a burst of 0, rather than a bucket that never refills.
+func (b *tokenBucket) take(burst int, refill time.Duration, now time.Time) bool {
+	if refill <= 0 {
+		return true
+	}
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += float64(now.Sub(b.last)) / float64(refill)
+	}
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// floodState tracks how fast a user is sending.
+// It is kept in the client's "flood" var, and only used from the server's goroutine.
+type floodState struct {
+	buckets        [floodKinds]tokenBucket
+	strikes        int       // How many times the user ran out of tokens, up to floodDisconnected
+	lastStrike     time.Time // Strikes are forgotten once this is FloodResetAfter ago
+	throttledUntil time.Time // Until then, buckets only hold one token
+	mutedUntil     time.Time // Until then, messages are refused
+}
+
+// floodLimit says how fast one kind of command can be sent
+type floodLimit struct {
+	burst  int // 0 is unlimited
+	refill time.Duration
+}
+
+// floodLimitFor gets the limit for a kind of command
+func (server *server) floodLimitFor(kind int) floodLimit {
+	config := server.config
+	switch kind {
+	case floodMessages:
+		return floodLimit{config.FloodMessageBurst, config.FloodMessageRefill}
+	case floodNicks:
+		return floodLimit{config.FloodNickBurst, config.FloodNickRefill}
+	}
+
+	return floodLimit{config.FloodCommandBurst, config.FloodCommandRefill}
+}
+
+// floodKind gets the kind of command a command is, for flood limits.
+// Returns -1 for commands that aren't limited, such as the ones the server runs itself.
+func floodKind(command *serverCommand) int {
+	switch command.command {
+	case "say", "msg", "reply", "me":
+		// say is internal, but only client handlers send it, with what the user typed
+		return floodMessages
+	case "nick":
+		return floodNicks
+	case "quit":
+		// Always let users leave
+		return -1
+	}
+	if !command.userInitiated {
+		return -1
+	}
+
+	return floodCommands
+}
+
+// checkFlood takes a token for a command from the user's bucket.
+// If the user is sending too fast, or is muted for flooding, they are told so,
+// and checkFlood returns false; the command must then be dropped.
+// Users who keep flooding are disconnected.
+func (server *server) checkFlood(command *serverCommand) bool {
+	kind := floodKind(command)
+	if kind < 0 {
+		return true
+	}
+	if oper, _ := command.client.GetVar("oper").(bool); oper {
+		return true
+	}
+
+	flood, ok := command.client.GetVar("flood").(*floodState)
+	if !ok {
+		flood = &floodState{}
+		command.client.SetVar("flood", flood)
+	}
+	if flood.strikes == floodDisconnected {
+		// Commands that were on their way when the user was disconnected
+		return false
+	}
+
+	now := time.Now()
+	if flood.strikes > 0 && now.Sub(flood.lastStrike) > server.config.FloodResetAfter {
+		flood.strikes = 0
+	}
+
+	limit := server.floodLimitFor(kind)
+	burst := limit.burst
+	if burst > 1 && now.Before(flood.throttledUntil) {
+		burst = 1
+	}
+	if burst > 0 && !flood.buckets[kind].take(burst, limit.refill, now) {
+		// Commands sent right after a strike are dropped without counting as another one,
+		// so a single burst can't get the user disconnected.
+		if now.Sub(flood.lastStrike) >= limit.refill {
+			server.floodStrike(command, flood, limit, now)
+		}
+		return false
+	}
+
+	if kind == floodMessages && now.Before(flood.mutedUntil) {
+		command.responseChan <- errorReply(fmt.Sprintf("You are muted for flooding for another %s.\n", flood.mutedUntil.Sub(now).Round(time.Second)))
+		return false
+	}
+
+	return true
+}
+
+// floodStrike takes the next step against a user who ran out of tokens
+func (server *server) floodStrike(command *serverCommand, flood *floodState, limit floodLimit, now time.Time) {
+	flood.strikes++
+	flood.lastStrike = now
+	config := server.config
+
+	switch flood.strikes {
+	case floodWarned:
+		command.responseChan <- errorReply("You are sending too fast; slow down, or you'll be throttled.\n")
+	case floodThrottled:
+		flood.throttledUntil = now.Add(config.FloodThrottleDuration)
+		command.responseChan <- errorReply(fmt.Sprintf("You are still sending too fast, so for the next %s you can only send one line every %s.\n", config.FloodThrottleDuration, limit.refill))
+	case floodMuted:
+		flood.mutedUntil = now.Add(config.FloodMuteDuration)
+		command.responseChan <- errorReply(fmt.Sprintf("You are muted for flooding for %s. Keep it up, and you'll be disconnected.\n", config.FloodMuteDuration))
+	default:
+		flood.strikes = floodDisconnected
+		// The user might have changed their nick since sending the command
+		nick, _ := command.client.GetVar("nick").(string)
+		if server.clients[strings.ToLower(nick)] == command.client {
+			disconnectUser(server, nick, command.client, floodReason)
+		}
+	}
+}
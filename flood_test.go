@@ -0,0 +1,159 @@
+package chatsrv
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestClient makes a client that isn't connected to anything, for commands that only use its vars
+func newTestClient(vars map[string]interface{}) *Client {
+	client := &Client{context: make(map[string]interface{})}
+	for name, value := range vars {
+		client.SetVar(name, value)
+	}
+
+	return client
+}
+
+func TestTokenBucketTake(t *testing.T) {
+	start := time.Date(2017, 4, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		burst  int
+		refill time.Duration
+		takes  []time.Duration // When each token is taken, after start
+		want   []bool
+	}{
+		{"burst", 3, time.Second, []time.Duration{0, 0, 0, 0}, []bool{true, true, true, false}},
+		{"refill", 1, time.Second, []time.Duration{0, 500 * time.Millisecond, time.Second}, []bool{true, false, true}},
+		{"partial refills add up", 1, time.Second, []time.Duration{0, 600 * time.Millisecond, 1200 * time.Millisecond}, []bool{true, false, true}},
+		{"refills stop at the burst", 2, time.Second, []time.Duration{0, time.Hour, time.Hour, time.Hour}, []bool{true, true, true, false}},
+		{"refill of 0 is unlimited", 1, 0, []time.Duration{0, 0, 0}, []bool{true, true, true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var bucket tokenBucket
+			for i, after := range test.takes {
+				if got := bucket.take(test.burst, test.refill, start.Add(after)); got != test.want[i] {
+					t.Errorf("take %d at %s = %v, want %v", i+1, after, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFloodKind(t *testing.T) {
+	tests := []struct {
+		command       string
+		userInitiated bool
+		want          int
+	}{
+		{"say", false, floodMessages},
+		{"msg", true, floodMessages},
+		{"me", true, floodMessages},
+		{"nick", true, floodNicks},
+		{"users", true, floodCommands},
+		{"quit", true, -1},
+		{"notify", false, -1},
+		{"adduser", false, -1},
+	}
+
+	for _, test := range tests {
+		command := &serverCommand{command: test.command, userInitiated: test.userInitiated}
+		if got := floodKind(command); got != test.want {
+			t.Errorf("floodKind(%s) = %d, want %d", test.command, got, test.want)
+		}
+	}
+}
+
+func TestCheckFlood(t *testing.T) {
+	tests := []struct {
+		name   string
+		burst  int
+		refill time.Duration
+		oper   bool
+		sends  int
+		want   int // How many sends get through
+		events int // How many errors the user is sent
+	}{
+		{"under the burst", 3, time.Hour, false, 3, 3, 0},
+		{"over the burst", 3, time.Hour, false, 6, 3, 1}, // Only the first command over counts as a strike
+		{"burst of 0 is unlimited", 0, time.Hour, false, 20, 20, 0},
+		{"refill of 0 is unlimited", 1, 0, false, 20, 20, 0},
+		{"operators are exempt", 1, time.Hour, true, 5, 5, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := NewServer(&ServerConfig{FloodMessageBurst: test.burst, FloodMessageRefill: test.refill})
+			client := newTestClient(map[string]interface{}{"nick": "alice", "oper": test.oper})
+			responseChan := make(chan *event, test.sends)
+			command := &serverCommand{nick: "alice", client: client, responseChan: responseChan, command: "say"}
+
+			got := 0
+			for i := 0; i < test.sends; i++ {
+				if server.checkFlood(command) {
+					got++
+				}
+			}
+			if got != test.want {
+				t.Errorf("%d of %d sends got through, want %d", got, test.sends, test.want)
+			}
+			if len(responseChan) != test.events {
+				t.Errorf("user was sent %d errors, want %d", len(responseChan), test.events)
+			}
+		})
+	}
+}
+
+func TestFloodStrikeEscalates(t *testing.T) {
+	config := &ServerConfig{FloodThrottleDuration: time.Minute, FloodMuteDuration: 2 * time.Minute}
+	server := NewServer(config)
+	client := newTestClient(map[string]interface{}{"nick": "alice"})
+	responseChan := make(chan *event, 10)
+	command := &serverCommand{nick: "alice", client: client, responseChan: responseChan, command: "say"}
+	flood := &floodState{}
+	limit := floodLimit{burst: 5, refill: time.Second}
+	now := time.Date(2017, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	server.floodStrike(command, flood, limit, now)
+	if flood.strikes != floodWarned || len(responseChan) != 1 {
+		t.Fatalf("after 1 strike: strikes = %d, %d errors; want warned, with 1 error", flood.strikes, len(responseChan))
+	}
+
+	server.floodStrike(command, flood, limit, now)
+	if flood.strikes != floodThrottled || !flood.throttledUntil.Equal(now.Add(time.Minute)) {
+		t.Fatalf("after 2 strikes: strikes = %d, throttled until %s; want throttled for a minute", flood.strikes, flood.throttledUntil)
+	}
+
+	server.floodStrike(command, flood, limit, now)
+	if flood.strikes != floodMuted || !flood.mutedUntil.Equal(now.Add(2*time.Minute)) {
+		t.Fatalf("after 3 strikes: strikes = %d, muted until %s; want muted for 2 minutes", flood.strikes, flood.mutedUntil)
+	}
+
+	server.floodStrike(command, flood, limit, now)
+	server.floodStrike(command, flood, limit, now)
+	if flood.strikes != floodDisconnected {
+		t.Fatalf("after 5 strikes: strikes = %d, want disconnected", flood.strikes)
+	}
+	if len(responseChan) != 3 {
+		t.Errorf("user was sent %d errors, want 3", len(responseChan))
+	}
+}
+
+func TestCheckFloodMuted(t *testing.T) {
+	server := NewServer(&ServerConfig{FloodMessageBurst: 10, FloodMessageRefill: time.Second, FloodCommandBurst: 10, FloodCommandRefill: time.Second})
+	client := newTestClient(map[string]interface{}{"nick": "alice"})
+	client.SetVar("flood", &floodState{strikes: floodMuted, lastStrike: time.Now(), mutedUntil: time.Now().Add(time.Minute)})
+	responseChan := make(chan *event, 10)
+
+	say := &serverCommand{nick: "alice", client: client, responseChan: responseChan, command: "say"}
+	if server.checkFlood(say) {
+		t.Error("muted user could talk")
+	}
+	users := &serverCommand{nick: "alice", client: client, responseChan: responseChan, command: "users", userInitiated: true}
+	if !server.checkFlood(users) {
+		t.Error("muted user couldn't run other commands")
+	}
+}
@@ -0,0 +1,147 @@
+package chatsrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// MUD clients that agree to GMCP get chat events as GMCP messages, along with the usual text.
+// Scripts can use them to keep a list of who's in the room, send messages to a tab per room, and so on.
+// The packages are:
+//
+//	Chat.Room.Info     The room the user joined, like {"name":"lobby","topic":"...","size":3,...}
+//	Chat.Room.Members  Everyone in that room, like [{"nick":"alice","mod":true}]
+//	Chat.Room.Topic    Someone changed the topic: {"room":"lobby","topic":"...","setBy":"alice"}
+//	Chat.Message       Something was said: {"room":"lobby","from":"alice","text":"Hi","time":"..."};
+//	                   "action" is true for /me, and private messages have "to" instead of "room"
+//	Chat.User.Join     Someone joined the room: {"room":"lobby","nick":"bob"}
+//	Chat.User.Leave    Someone left the room: {"room":"lobby","nick":"bob","reason":"..."}
+//	Chat.User.Nick     Someone changed their nick: {"from":"bob","to":"robert"}
+//
+// If the client sends Core.Supports.Set, it only gets them if it listed Chat.
+
+// gmcpPackage is a GMCP message waiting to be sent
+type gmcpPackage struct {
+	name string
+	data interface{}
+}
+
+type gmcpMessage struct {
+	Room   string    `json:"room,omitempty"`
+	From   string    `json:"from"`
+	To     string    `json:"to,omitempty"`
+	Text   string    `json:"text"`
+	Action bool      `json:"action,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+type gmcpUser struct {
+	Room   string `json:"room"`
+	Nick   string `json:"nick"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type gmcpNick struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type gmcpTopic struct {
+	Room  string `json:"room"`
+	Topic string `json:"topic"`
+	SetBy string `json:"setBy,omitempty"`
+}
+
+// gmcpPackages gets the GMCP messages for an event, if there are any
+func gmcpPackages(ev *event) []gmcpPackage {
+	switch ev.Type {
+	case eventMessage, eventAction:
+		return []gmcpPackage{{"Chat.Message", gmcpMessage{Room: ev.Room, From: ev.From, Text: ev.Body, Action: ev.Type == eventAction, Time: ev.Time}}}
+	case eventPrivate:
+		return []gmcpPackage{{"Chat.Message", gmcpMessage{From: ev.From, To: ev.To, Text: ev.Body, Time: ev.Time}}}
+	case eventJoin:
+		return []gmcpPackage{{"Chat.User.Join", gmcpUser{Room: ev.Room, Nick: ev.From}}}
+	case eventLeave:
+		return []gmcpPackage{{"Chat.User.Leave", gmcpUser{Room: ev.Room, Nick: ev.From, Reason: ev.Body}}}
+	case eventNick:
+		return []gmcpPackage{{"Chat.User.Nick", gmcpNick{From: ev.From, To: ev.To}}}
+	case eventTopic:
+		return []gmcpPackage{{"Chat.Room.Topic", gmcpTopic{Room: ev.Room, Topic: ev.Body, SetBy: ev.From}}}
+	case eventJoined:
+		info, ok := ev.Data.(*roomInfo)
+		if !ok {
+			return nil
+		}
+		roomOnly := *info
+		roomOnly.Members = nil
+		members := info.Members
+		if members == nil {
+			members = []roomMember{}
+		}
+		return []gmcpPackage{{"Chat.Room.Info", &roomOnly}, {"Chat.Room.Members", members}}
+	}
+
+	return nil
+}
+
+// sendGMCP sends the GMCP messages for an event, if the client wants them
+func sendGMCP(client *Client, ev *event) {
+	t, ok := client.GetVar("telnet").(*telnetConn)
+	if !ok || !t.wantsGMCP("Chat") {
+		return
+	}
+
+	for _, pkg := range gmcpPackages(ev) {
+		data, err := json.Marshal(pkg.data)
+		if err != nil {
+			log.Printf("Cannot encode GMCP %s: %s\n", pkg.name, err)
+			continue
+		}
+
+		message := append([]byte(pkg.name+" "), data...)
+		frame := []byte{telnetIAC, telnetSB, telnetOptGMCP}
+		frame = append(frame, bytes.Replace(message, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC}, -1)...)
+		client.Send <- append(frame, telnetIAC, telnetSE)
+	}
+}
+
+// wantsGMCP returns true if the client agreed to GMCP, and didn't leave pkg out of its supported packages.
+func (t *telnetConn) wantsGMCP(pkg string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.gmcp {
+		return false
+	}
+
+	return t.gmcpSupports == nil || t.gmcpSupports[strings.ToLower(pkg)]
+}
+
+// receiveGMCP handles a GMCP message from the client.
+// Only Core.Supports messages mean anything to the server.
+func (t *telnetConn) receiveGMCP(message string) {
+	name, payload := splitFirstWord(message)
+	var packages []string
+	switch strings.ToLower(name) {
+	case "core.supports.set", "core.supports.add", "core.supports.remove":
+		// Packages look like "Chat 1"; the version doesn't matter here
+		if err := json.Unmarshal([]byte(payload), &packages); err != nil {
+			return
+		}
+	default:
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if strings.ToLower(name) == "core.supports.set" || t.gmcpSupports == nil {
+		t.gmcpSupports = make(map[string]bool)
+	}
+	for _, pkg := range packages {
+		pkgName, _ := splitFirstWord(pkg)
+		t.gmcpSupports[strings.ToLower(pkgName)] = strings.ToLower(name) != "core.supports.remove"
+	}
+}
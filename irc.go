@@ -0,0 +1,892 @@
+package chatsrv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Name the server goes by in IRC messages.
+// IRC needs something that looks like a host name, which ServerName might not.
+const ircServerName = "chatsrv"
+
+// Most names listed in one RPL_NAMREPLY line
+const ircNamesPerLine = 50
+
+// serveIRC runs the IRC listener on config.IRCBindAddr
+func (server *server) serveIRC() {
+	listener, err := server.listen(server.config.IRCBindAddr)
+	if err != nil {
+		log.Printf("Cannot start the IRC listener, binding on %s; %s\n", server.config.IRCBindAddr, err)
+		return
+	}
+	defer listener.Close()
+
+	server.runningLock.Lock()
+	if server.shuttingDown {
+		server.runningLock.Unlock()
+		return
+	}
+	server.ircListener = listener
+	server.runningLock.Unlock()
+	log.Printf("Listening for IRC on %s\n", server.config.IRCBindAddr)
+
+	server.acceptConnections(listener, "irc", ircClientHandler{server})
+	log.Printf("Stopped listening for IRC on %s\n", server.config.IRCBindAddr)
+}
+
+// ircClientHandler lets IRC clients use the chat server.
+// Their commands are translated into the server's commands, and events are sent back as IRC messages.
+// Rooms look like channels, with a # in front of their names.
+// Users can only be in one room at a time, so joining a channel parts the one they were in.
+// IRC commands that aren't understood are passed on to the server as they are,
+// so the rest of the server's commands, such as /create or /history, can still be used.
+type ircClientHandler defaultClientHandler
+
+func (ch ircClientHandler) Handle(client *Client) string {
+	session := &ircSession{server: ch.server, client: client}
+	if exitReason := session.register(); exitReason != "" {
+		return exitReason
+	}
+
+	return session.run()
+}
+
+// ircSession holds what an IRC client's handler knows about its user
+type ircSession struct {
+	server       *server
+	client       *Client
+	nick         string
+	responseChan chan *event
+	queue        *sendQueue
+	room         string       // Room the user is in, or ""
+	topic        roomTopic    // The room's topic, as far as the session knows
+	pending      []ircRequest // NAMES and WHO requests waiting for the list of users, oldest first
+}
+
+// ircRequest is a NAMES or WHO request, waiting for the server to reply to /users
+type ircRequest struct {
+	command string
+	mask    string // Channel or nick to list
+}
+
+// register waits for the client to send NICK and USER, and adds the user to the server.
+// If the nick is registered, its password must have been sent with PASS.
+// Returns "" once the user is on the server, or the reason the client should be disconnected.
+func (s *ircSession) register() string {
+	var password string
+	gotUser := false
+	for {
+		for s.nick == "" || !gotUser {
+			data, exitReason := s.readLine()
+			if exitReason != "" {
+				return exitReason
+			}
+
+			command, params := parseIRCMessage(string(data))
+			switch command {
+			case "":
+			case "CAP":
+				// No capabilities are supported, but clients that ask need an answer before they carry on
+				if len(params) >= 1 && strings.ToUpper(params[0]) == "LS" {
+					s.send(ircServerName, "CAP", "*", "LS", "")
+				} else if len(params) >= 2 && strings.ToUpper(params[0]) == "REQ" {
+					s.send(ircServerName, "CAP", "*", "NAK", params[1])
+				}
+			case "PASS":
+				if len(params) >= 1 {
+					password = params[0]
+				}
+			case "NICK":
+				if len(params) < 1 {
+					s.numeric("431", "No nickname given")
+				} else if !isValidNick(params[0]) {
+					s.numeric("432", params[0], "Nicks can contain only letters and numbers")
+				} else {
+					s.nick = params[0]
+				}
+			case "USER":
+				if len(params) < 4 {
+					s.numeric("461", "USER", "Not enough parameters")
+				} else {
+					gotUser = true
+				}
+			case "PING":
+				s.pong(params)
+			case "QUIT":
+				return "User quit"
+			default:
+				s.numeric("451", "You have not registered")
+			}
+		}
+
+		if exitReason := s.authenticate(password); exitReason != "" {
+			return exitReason
+		}
+
+		items, ok := s.addUser()
+		if ok {
+			s.welcome()
+			for _, ev := range items[1:] {
+				s.handleEvent(ev)
+			}
+			return ""
+		}
+
+		if s.server.isShuttingDown() {
+			s.send("", "ERROR", s.server.farewell())
+			return "Server shutting down"
+		}
+		taken := s.nick
+		s.nick = ""
+		s.numeric("433", taken, "That nick is already taken")
+		s.client.UnsetVar("account")
+	}
+}
+
+// readLine waits for the client to send a line.
+// Returns the line, or the reason the client should be disconnected instead.
+func (s *ircSession) readLine() ([]byte, string) {
+	select {
+	case data, ok := <-s.client.Recv:
+		if !ok {
+			return nil, "Interrupted"
+		}
+		return data, ""
+	case <-s.server.quit:
+		s.send("", "ERROR", s.server.farewell())
+		return nil, "Server shutting down"
+	}
+}
+
+// authenticate checks the password sent with PASS, if the user's nick is registered.
+// Returns "" if they can use the nick, or the reason they'll be disconnected.
+func (s *ircSession) authenticate(password string) string {
+	store := s.server.config.AccountStore
+	if store == nil {
+		return ""
+	}
+
+	account, err := store.Account(s.nick)
+	if err == ErrNoAccount {
+		return ""
+	}
+	if err != nil {
+		log.Printf("Error looking up account for %s: %s\n", s.nick, err)
+		s.send("", "ERROR", "Cannot check if that nick is registered; try again later")
+		return "Error looking up account"
+	}
+	if !account.CheckPassword(password) {
+		s.server.auditLogger.log(auditEntry{Action: "password-failed", Nick: account.Nick, Host: describeHost(s.client), Details: "Wrong password for account"})
+		s.numeric("464", "That nick is registered; send its password with PASS")
+		s.send("", "ERROR", "Wrong password")
+		return "Wrong password"
+	}
+
+	s.nick = account.Nick // Use the case the nick was registered with
+	s.client.SetVar("account", account.Nick)
+	return ""
+}
+
+// addUser adds the user to the server.
+// Returns the events received so far, starting with the welcome,
+// or false if the nick was taken or the server is shutting down.
+func (s *ircSession) addUser() ([]*event, bool) {
+	s.client.SetVar("nick", s.nick)
+	s.responseChan, s.queue = startSendQueue(s.server, s.client)
+	s.server.in <- &serverCommand{
+		nick:         s.nick,
+		client:       s.client,
+		responseChan: s.responseChan,
+		command:      "adduser",
+	}
+
+	// adduser always responds, and then closes responseChan if the user wasn't added
+	<-s.queue.ready
+	items, _, _ := s.queue.pop()
+	return items, len(items) > 0 && items[0].Type == eventWelcome
+}
+
+// welcome sends the numerics clients expect once they're registered
+func (s *ircSession) welcome() {
+	s.numeric("001", fmt.Sprintf("Welcome to %s, %s", s.server.config.ServerName, s.nick))
+	s.numeric("002", fmt.Sprintf("Your host is %s", ircServerName))
+	s.numeric("004", ircServerName, "chatsrv", "o", "bo")
+	s.numeric("005", "CHANTYPES=#", "PREFIX=(o)@", "CHANMODES=b,,,", "are supported by this server")
+	s.motd()
+}
+
+// motd sends the message of the day
+func (s *ircSession) motd() {
+	motd := strings.TrimRight(s.server.config.Motd, "\n")
+	if motd == "" {
+		s.numeric("422", "There is no message of the day")
+		return
+	}
+
+	s.numeric("375", fmt.Sprintf("- %s Message of the day -", ircServerName))
+	for _, line := range strings.Split(motd, "\n") {
+		s.numeric("372", "- "+line)
+	}
+	s.numeric("376", "End of /MOTD command")
+}
+
+// run passes commands from the client to the server, and events from the server to the client,
+// until one of them hangs up.
+func (s *ircSession) run() string {
+	for {
+		select {
+		case <-s.queue.ready:
+			items, overflowed, closed := s.queue.pop()
+			for _, ev := range items {
+				s.handleEvent(ev)
+			}
+
+			if overflowed {
+				s.server.in <- &serverCommand{
+					nick:         s.nick,
+					client:       s.client,
+					responseChan: s.responseChan,
+					command:      "rmuser",
+					args:         []string{sendQueueOverflowReason},
+				}
+
+				return sendQueueOverflowReason
+			}
+			if closed {
+				// Server closes responseChan to kick a client
+				s.send("", "ERROR", "Closing link")
+				return "Disconnected by server"
+			}
+		case data, ok := <-s.client.Recv:
+			if !ok {
+				var reason []string
+				if s.client.StoppedReason() == sendQueueOverflowReason {
+					reason = append(reason, sendQueueOverflowReason)
+				}
+				s.server.in <- &serverCommand{
+					nick:         s.nick,
+					client:       s.client,
+					responseChan: s.responseChan,
+					command:      "rmuser",
+					args:         reason,
+				}
+
+				return "User disconnected"
+			}
+
+			s.handleCommand(string(data))
+		}
+	}
+}
+
+// handleCommand translates a command from the client into one the server understands
+func (s *ircSession) handleCommand(line string) {
+	command, params := parseIRCMessage(line)
+	switch command {
+	case "", "PONG", "CAP":
+	case "USERHOST", "ISON":
+		// Some clients send these by themselves; they aren't supported, but complaining about them would just be noise
+	case "PASS", "USER":
+		s.numeric("462", "You may not reregister")
+	case "PING":
+		s.pong(params)
+	case "NICK":
+		if len(params) < 1 {
+			s.numeric("431", "No nickname given")
+			return
+		}
+		s.command("nick", params[0])
+	case "JOIN":
+		if len(params) < 1 {
+			s.numeric("461", command, "Not enough parameters")
+			return
+		}
+		// Users can only be in one room, so only the first channel is joined
+		channel := strings.Split(params[0], ",")[0]
+		if channel == "0" {
+			if s.room != "" {
+				s.command("leave")
+			}
+			return
+		}
+		args := []string{strings.TrimPrefix(channel, "#")}
+		if len(params) >= 2 {
+			args = append(args, strings.Split(params[1], ",")[0])
+		}
+		s.command("join", args...)
+	case "PART":
+		if len(params) < 1 {
+			s.numeric("461", command, "Not enough parameters")
+			return
+		}
+		if !s.inChannel(params[0]) {
+			s.numeric("442", params[0], "You're not on that channel")
+			return
+		}
+		s.command("leave", params[1:]...)
+	case "PRIVMSG", "NOTICE":
+		if len(params) < 2 {
+			if command == "PRIVMSG" {
+				s.numeric("412", "No text to send")
+			}
+			return
+		}
+		s.sendText(command, params[0], params[1])
+	case "TOPIC":
+		if len(params) < 1 {
+			s.numeric("461", command, "Not enough parameters")
+			return
+		}
+		if !s.inChannel(params[0]) {
+			s.numeric("442", params[0], "You're not on that channel")
+			return
+		}
+		if len(params) == 1 {
+			s.sendTopic()
+			return
+		}
+		s.command("topic", params[1])
+	case "NAMES":
+		channel := "#" + s.room
+		if len(params) >= 1 {
+			channel = strings.Split(params[0], ",")[0]
+		}
+		s.pending = append(s.pending, ircRequest{command: command, mask: channel})
+		s.command("users")
+	case "WHO":
+		mask := "*"
+		if len(params) >= 1 {
+			mask = params[0]
+		}
+		s.pending = append(s.pending, ircRequest{command: command, mask: mask})
+		s.command("users")
+	case "LIST":
+		s.command("rooms")
+	case "WHOIS":
+		if len(params) < 1 {
+			s.numeric("431", "No nickname given")
+			return
+		}
+		// The nick comes last; a server to ask can come before it
+		s.command("whois", params[len(params)-1])
+	case "KICK":
+		if len(params) < 2 {
+			s.numeric("461", command, "Not enough parameters")
+			return
+		}
+		if !s.inChannel(params[0]) {
+			s.numeric("442", params[0], "You're not on that channel")
+			return
+		}
+		s.command("kick", params[1:]...)
+	case "MODE":
+		s.mode(params)
+	case "AWAY":
+		if len(params) < 1 || params[0] == "" {
+			s.command("back")
+			return
+		}
+		s.command("away", params[0])
+	case "MOTD":
+		s.motd()
+	case "QUIT":
+		s.command("quit", params...)
+	default:
+		s.command(strings.ToLower(command), params...)
+	}
+}
+
+// command sends a command to the server, as if the user typed it
+func (s *ircSession) command(command string, args ...string) {
+	s.server.in <- &serverCommand{
+		nick:          s.nick,
+		client:        s.client,
+		responseChan:  s.responseChan,
+		command:       command,
+		args:          args,
+		userInitiated: true,
+	}
+}
+
+// sendText sends a PRIVMSG or NOTICE to the room, or to another user
+func (s *ircSession) sendText(command, target, text string) {
+	// Strip formatting codes and other non graphic characters, but keep the ones marking CTCP messages
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsGraphic(r) || r == '\x01' {
+			return r
+		}
+		return -1
+	}, text)
+
+	action, isAction := ircAction(text)
+	if !isAction && strings.HasPrefix(text, "\x01") {
+		// Other CTCP requests aren't supported
+		return
+	}
+
+	if strings.HasPrefix(target, "#") {
+		if !s.inChannel(target) {
+			if command == "PRIVMSG" {
+				s.numeric("404", target, "Cannot send to channel; you aren't in it")
+			}
+			return
+		}
+		if isAction {
+			s.command("me", action)
+			return
+		}
+
+		s.server.in <- &serverCommand{
+			nick:         s.nick,
+			client:       s.client,
+			responseChan: s.responseChan,
+			command:      "say",
+			args:         []string{s.room, text},
+		}
+		return
+	}
+
+	if isAction {
+		text = fmt.Sprintf("* %s %s", s.nick, action)
+	}
+	s.command("msg", target, text)
+}
+
+// mode handles MODE, translating +o, -o, +b and -b into the server's moderator commands
+func (s *ircSession) mode(params []string) {
+	if len(params) < 1 {
+		s.numeric("461", "MODE", "Not enough parameters")
+		return
+	}
+
+	channel := params[0]
+	if !strings.HasPrefix(channel, "#") {
+		// User modes aren't supported
+		s.numeric("221", "+")
+		return
+	}
+	if !s.inChannel(channel) {
+		s.numeric("442", channel, "You're not on that channel")
+		return
+	}
+	if len(params) == 1 {
+		s.numeric("324", channel, "+")
+		return
+	}
+
+	adding := true
+	args := params[2:]
+	for _, mode := range params[1] {
+		switch mode {
+		case '+', '-':
+			adding = mode == '+'
+		case 'o':
+			if len(args) == 0 {
+				continue
+			}
+			if adding {
+				s.command("op", args[0])
+			} else {
+				s.command("deop", args[0])
+			}
+			args = args[1:]
+		case 'b':
+			if len(args) == 0 {
+				// The ban list is sent when the server replies
+				s.command("bans")
+				continue
+			}
+			if adding {
+				s.command("ban", args[0])
+			} else {
+				s.command("unban", args[0])
+			}
+			args = args[1:]
+		default:
+			s.numeric("472", string(mode), "is unknown mode char to me")
+		}
+	}
+}
+
+// handleEvent sends an event from the server to the client, as IRC messages
+func (s *ircSession) handleEvent(ev *event) {
+	switch ev.Type {
+	case eventMessage:
+		// IRC clients show what their users said themselves
+		if ev.From == s.nick {
+			return
+		}
+		for _, line := range strings.Split(ev.Body, "\n") {
+			s.send(ircPrefix(ev.From), "PRIVMSG", "#"+ev.Room, line)
+		}
+	case eventAction:
+		if ev.From == s.nick {
+			return
+		}
+		for _, line := range strings.Split(ev.Body, "\n") {
+			s.send(ircPrefix(ev.From), "PRIVMSG", "#"+ev.Room, "\x01ACTION "+line+"\x01")
+		}
+	case eventPrivate:
+		if ev.From == s.nick {
+			return
+		}
+		for _, line := range strings.Split(ev.Body, "\n") {
+			s.send(ircPrefix(ev.From), "PRIVMSG", s.nick, line)
+		}
+	case eventNotice:
+		for _, line := range ircTextLines(ev.Text) {
+			s.send(ircServerName, "NOTICE", "#"+ev.Room, line)
+		}
+	case eventJoin:
+		if ev.From == s.nick {
+			s.joined(ev.Room, nil)
+			return
+		}
+		s.send(ircPrefix(ev.From), "JOIN", "#"+ev.Room)
+	case eventJoined:
+		info, _ := ev.Data.(*roomInfo)
+		s.joined(ev.Room, info)
+	case eventLeave:
+		if ev.From == s.nick {
+			if ev.Room == s.room {
+				s.part(ev.Body)
+			}
+			return
+		}
+		if ev.Body == "" {
+			s.send(ircPrefix(ev.From), "PART", "#"+ev.Room)
+		} else {
+			s.send(ircPrefix(ev.From), "PART", "#"+ev.Room, ev.Body)
+		}
+	case eventNick:
+		s.send(ircPrefix(ev.From), "NICK", ev.To)
+		if ev.From == s.nick {
+			s.nick = ev.To
+		}
+	case eventTopic:
+		s.topic = roomTopic{text: ev.Body, setBy: ev.From, setAt: ev.Time}
+		s.send(ircPrefix(ev.From), "TOPIC", "#"+ev.Room, ev.Body)
+	case eventUsers:
+		users, _ := ev.Data.([]userInfo)
+		if len(s.pending) == 0 {
+			// Someone typed /users themselves
+			s.notice(ev.Text)
+			return
+		}
+		request := s.pending[0]
+		s.pending = s.pending[1:]
+		s.listUsers(request, users)
+	case eventRooms:
+		rooms, _ := ev.Data.([]*roomInfo)
+		s.numeric("321", "Channel", "Users Name")
+		for _, room := range rooms {
+			s.numeric("322", "#"+room.Name, strconv.Itoa(room.Size), room.Topic)
+		}
+		s.numeric("323", "End of /LIST")
+	case eventAway:
+		if ev.From == s.nick {
+			s.numeric("306", "You have been marked as being away")
+			return
+		}
+		s.numeric("301", ev.From, ev.Body)
+	case eventBack:
+		s.numeric("305", "You are no longer marked as being away")
+	case eventBans:
+		bans, ok := ev.Data.([]banInfo)
+		if !ok {
+			s.notice(ev.Text)
+			return
+		}
+		s.listBans("#"+ev.Room, bans)
+	case eventWhois:
+		info, ok := ev.Data.(*whoisInfo)
+		if !ok {
+			s.notice(ev.Text)
+			return
+		}
+		s.whois(info)
+	default:
+		s.notice(ev.Text)
+	}
+}
+
+// joined updates the client when the user joins a room.
+// If info is nil, only the JOIN is sent; the topic and names are sent when info comes.
+func (s *ircSession) joined(room string, info *roomInfo) {
+	if room != s.room {
+		if s.room != "" {
+			// Joining a room leaves the one the user was in
+			s.part("")
+		}
+		s.room = room
+		s.topic = roomTopic{}
+		s.send(ircPrefix(s.nick), "JOIN", "#"+room)
+	}
+	if info == nil {
+		return
+	}
+
+	s.topic = roomTopic{text: info.Topic, setBy: info.TopicSetBy, setAt: info.TopicSetAt}
+	s.sendTopic()
+	s.sendNames("#"+room, info.Members)
+}
+
+// part tells the client the user left their room
+func (s *ircSession) part(reason string) {
+	if reason == "" {
+		s.send(ircPrefix(s.nick), "PART", "#"+s.room)
+	} else {
+		s.send(ircPrefix(s.nick), "PART", "#"+s.room, reason)
+	}
+	s.room = ""
+	s.topic = roomTopic{}
+}
+
+// sendTopic sends the topic of the user's room
+func (s *ircSession) sendTopic() {
+	channel := "#" + s.room
+	if s.topic.text == "" {
+		s.numeric("331", channel, "No topic is set")
+		return
+	}
+
+	s.numeric("332", channel, s.topic.text)
+	if s.topic.setBy != "" {
+		s.numeric("333", channel, s.topic.setBy, strconv.FormatInt(s.topic.setAt.Unix(), 10))
+	}
+}
+
+// sendNames lists the members of a channel, with @ in front of moderators
+func (s *ircSession) sendNames(channel string, members []roomMember) {
+	names := make([]string, 0, len(members))
+	for _, member := range members {
+		if member.Mod {
+			names = append(names, "@"+member.Nick)
+		} else {
+			names = append(names, member.Nick)
+		}
+	}
+
+	for len(names) > 0 {
+		n := len(names)
+		if n > ircNamesPerLine {
+			n = ircNamesPerLine
+		}
+		s.numeric("353", "=", channel, strings.Join(names[:n], " "))
+		names = names[n:]
+	}
+	s.numeric("366", channel, "End of /NAMES list")
+}
+
+// listBans lists a channel's bans, each as the nick or host pattern MODE -b takes to remove it
+func (s *ircSession) listBans(channel string, bans []banInfo) {
+	for _, ban := range bans {
+		mask := ban.Nick
+		if mask == "" {
+			mask = ban.HostPattern
+		}
+		s.numeric("367", channel, mask, ban.SetBy)
+	}
+	s.numeric("368", channel, "End of channel ban list")
+}
+
+// listUsers answers a NAMES or WHO request
+func (s *ircSession) listUsers(request ircRequest, users []userInfo) {
+	var matches []userInfo
+	for _, user := range users {
+		if request.mask == "*" ||
+			(strings.HasPrefix(request.mask, "#") && strings.EqualFold(user.Room, strings.TrimPrefix(request.mask, "#"))) ||
+			strings.EqualFold(user.Nick, request.mask) {
+			matches = append(matches, user)
+		}
+	}
+
+	if request.command == "NAMES" {
+		members := make([]roomMember, 0, len(matches))
+		for _, user := range matches {
+			members = append(members, roomMember{Nick: user.Nick, Mod: user.Mod})
+		}
+		s.sendNames(request.mask, members)
+		return
+	}
+
+	for _, user := range matches {
+		channel := "*"
+		if user.Room != "" {
+			channel = "#" + user.Room
+		}
+		flags := "H"
+		if user.Away != "" {
+			flags = "G"
+		}
+		if user.Mod {
+			flags += "@"
+		}
+		s.numeric("352", channel, user.Nick, ircServerName, ircServerName, user.Nick, flags, "0 "+user.Nick)
+	}
+	s.numeric("315", request.mask, "End of /WHO list")
+}
+
+// whois answers a WHOIS request
+func (s *ircSession) whois(info *whoisInfo) {
+	s.numeric("311", info.Nick, info.Nick, ircServerName, "*", info.Nick)
+	if info.Host != "" {
+		s.numeric("378", info.Nick, "is connecting from "+info.Host)
+	}
+	if info.Room != "" {
+		s.numeric("319", info.Nick, "#"+info.Room)
+	}
+	if info.Away != "" {
+		s.numeric("301", info.Nick, info.Away)
+	}
+	s.numeric("312", info.Nick, ircServerName, s.server.config.ServerName)
+	if info.Account != "" {
+		s.numeric("330", info.Nick, info.Account, "is logged in as")
+	}
+	if info.Operator {
+		s.numeric("313", info.Nick, "is a server operator")
+	}
+	if !info.LastSeen.IsZero() {
+		s.numeric("317", info.Nick, strconv.Itoa(int(time.Since(info.LastSeen)/time.Second)), "seconds idle")
+	}
+	s.numeric("318", info.Nick, "End of /WHOIS list")
+}
+
+// inChannel returns true if channel is the user's room
+func (s *ircSession) inChannel(channel string) bool {
+	return s.room != "" && strings.EqualFold(strings.TrimPrefix(channel, "#"), s.room)
+}
+
+// notice sends text from the server to the user, a line at a time
+func (s *ircSession) notice(text string) {
+	target := s.nick
+	if target == "" {
+		target = "*"
+	}
+
+	for _, line := range ircTextLines(text) {
+		s.send(ircServerName, "NOTICE", target, line)
+	}
+}
+
+// numeric sends a numeric reply to the user
+func (s *ircSession) numeric(code string, params ...string) {
+	target := s.nick
+	if target == "" {
+		target = "*"
+	}
+
+	s.send(ircServerName, code, append([]string{target}, params...)...)
+}
+
+// pong answers a PING
+func (s *ircSession) pong(params []string) {
+	token := ircServerName
+	if len(params) >= 1 {
+		token = params[0]
+	}
+
+	s.send(ircServerName, "PONG", ircServerName, token)
+}
+
+// send sends an IRC message to the client
+func (s *ircSession) send(prefix, command string, params ...string) {
+	s.client.Send <- []byte(formatIRCMessage(prefix, command, params...))
+}
+
+// ircPrefix gets the prefix for messages from a user
+func ircPrefix(nick string) string {
+	return fmt.Sprintf("%s!%s@%s", nick, nick, ircServerName)
+}
+
+// ircAction gets the action from a CTCP ACTION message, which is how IRC clients send /me
+func ircAction(text string) (string, bool) {
+	if !strings.HasPrefix(text, "\x01ACTION ") {
+		return "", false
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01"), true
+}
+
+// ircTextLines splits text meant for line-based clients into lines that can be sent in notices.
+// Blank lines are left out, as IRC messages can't be empty.
+func ircTextLines(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " ")
+		if line != "" {
+			lines = append(lines, strings.Replace(line, "\t", "    ", -1))
+		}
+	}
+
+	return lines
+}
+
+// parseIRCMessage splits a message from a client into its command, in upper case, and parameters.
+// Tags and the prefix, if there are any, are ignored.
+func parseIRCMessage(line string) (string, []string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") || strings.HasPrefix(line, ":") {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return "", nil
+		}
+		line = strings.TrimLeft(line[i+1:], " ")
+		// Tags can be followed by a prefix
+		if strings.HasPrefix(line, ":") {
+			return parseIRCMessage(line)
+		}
+	}
+
+	var words []string
+	for line != "" {
+		if line[0] == ':' && len(words) > 0 {
+			// The trailing parameter can contain spaces
+			words = append(words, line[1:])
+			break
+		}
+
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			words = append(words, line)
+			break
+		}
+		words = append(words, line[:i])
+		line = strings.TrimLeft(line[i+1:], " ")
+	}
+
+	if len(words) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(words[0]), words[1:]
+}
+
+// formatIRCMessage formats an IRC message to send to a client.
+// Only the last parameter can contain spaces.
+func formatIRCMessage(prefix, command string, params ...string) string {
+	parts := make([]string, 0, len(params)+2)
+	if prefix != "" {
+		parts = append(parts, ":"+prefix)
+	}
+	parts = append(parts, command)
+	for i, param := range params {
+		// Line breaks would end the message early
+		param = strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' {
+				return ' '
+			}
+			return r
+		}, param)
+		if i == len(params)-1 && (param == "" || strings.HasPrefix(param, ":") || strings.Contains(param, " ")) {
+			param = ":" + param
+		}
+		parts = append(parts, param)
+	}
+
+	return strings.Join(parts, " ") + "\r\n"
+}
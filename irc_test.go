@@ -0,0 +1,217 @@
+package chatsrv
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseIRCMessage(t *testing.T) {
+	tests := []struct {
+		line    string
+		command string
+		params  []string
+	}{
+		{"NICK alice", "NICK", []string{"alice"}},
+		{"nick alice", "NICK", []string{"alice"}},
+		{"PRIVMSG #lobby :Hello, everyone\r\n", "PRIVMSG", []string{"#lobby", "Hello, everyone"}},
+		{"PRIVMSG #lobby :", "PRIVMSG", []string{"#lobby", ""}},
+		{"PRIVMSG #lobby ::)", "PRIVMSG", []string{"#lobby", ":)"}},
+		{"PRIVMSG #lobby :a  b ", "PRIVMSG", []string{"#lobby", "a  b "}},
+		{"USER alice 0 * :Alice Liddell", "USER", []string{"alice", "0", "*", "Alice Liddell"}},
+		{"MODE  #lobby   +o   bob", "MODE", []string{"#lobby", "+o", "bob"}},
+		{":alice!alice@example.com PRIVMSG bob :Hi", "PRIVMSG", []string{"bob", "Hi"}},
+		{"@time=2017-04-01T12:00:00Z PING :token", "PING", []string{"token"}},
+		{"@label=1;draft/x=y :alice PING token", "PING", []string{"token"}},
+		{"QUIT", "QUIT", []string{}},
+		{":", "", nil},
+		{":alice", "", nil},
+		{"@tags", "", nil},
+		{"", "", nil},
+		{"\r\n", "", nil},
+	}
+
+	for _, test := range tests {
+		command, params := parseIRCMessage(test.line)
+		if command != test.command || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("parseIRCMessage(%q) = %q, %q; want %q, %q", test.line, command, params, test.command, test.params)
+		}
+	}
+}
+
+func TestFormatIRCMessage(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		command string
+		params  []string
+		want    string
+	}{
+		{"", "PING", []string{"token"}, "PING token\r\n"},
+		{"chatsrv", "001", []string{"alice", "Welcome to Test, alice"}, ":chatsrv 001 alice :Welcome to Test, alice\r\n"},
+		{"alice!alice@chatsrv", "PRIVMSG", []string{"#lobby", "Hi"}, ":alice!alice@chatsrv PRIVMSG #lobby Hi\r\n"},
+		{"chatsrv", "331", []string{"alice", "#lobby", ""}, ":chatsrv 331 alice #lobby :\r\n"},
+		{"", "PRIVMSG", []string{"#lobby", ":)"}, "PRIVMSG #lobby ::)\r\n"},
+		{"", "PRIVMSG", []string{"#lobby", "line one\r\nline two"}, "PRIVMSG #lobby :line one  line two\r\n"},
+		{"", "PRIVMSG", []string{"#lobby", "a\nb"}, "PRIVMSG #lobby :a b\r\n"},
+		{"", "QUIT", nil, "QUIT\r\n"},
+	}
+
+	for _, test := range tests {
+		if got := formatIRCMessage(test.prefix, test.command, test.params...); got != test.want {
+			t.Errorf("formatIRCMessage(%q, %q, %q) = %q, want %q", test.prefix, test.command, test.params, got, test.want)
+		}
+	}
+}
+
+func TestFormatIRCMessageRoundTrip(t *testing.T) {
+	params := []string{"#lobby", "Hello: how are you?"}
+	command, got := parseIRCMessage(formatIRCMessage("alice", "PRIVMSG", params...))
+	if command != "PRIVMSG" || !reflect.DeepEqual(got, params) {
+		t.Errorf("parsed %q, %q; want PRIVMSG, %q", command, got, params)
+	}
+}
+
+func TestIRCAction(t *testing.T) {
+	tests := []struct {
+		text     string
+		action   string
+		isAction bool
+	}{
+		{"\x01ACTION waves\x01", "waves", true},
+		{"\x01ACTION waves", "waves", true}, // Some clients leave off the closing \x01
+		{"\x01ACTION \x01", "", true},
+		{"\x01VERSION\x01", "", false},
+		{"ACTION waves", "", false},
+		{"waves", "", false},
+	}
+
+	for _, test := range tests {
+		action, isAction := ircAction(test.text)
+		if action != test.action || isAction != test.isAction {
+			t.Errorf("ircAction(%q) = %q, %v; want %q, %v", test.text, action, isAction, test.action, test.isAction)
+		}
+	}
+}
+
+func TestIRCTextLines(t *testing.T) {
+	got := ircTextLines("Users:\n\nalice\tlobby  \n\n")
+	want := []string{"Users:", "alice    lobby"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ircTextLines = %q, want %q", got, want)
+	}
+}
+
+// newTestIRCSession makes a session for nick, in room, that isn't connected to anything.
+// Commands it sends to the server can be read from the server's in channel, and what it sends the client from client.Send.
+func newTestIRCSession(nick, room string) *ircSession {
+	client := newTestClient(map[string]interface{}{"nick": nick})
+	client.Send = make(chan []byte, 100)
+	return &ircSession{
+		server:       NewServer(&ServerConfig{}),
+		client:       client,
+		nick:         nick,
+		responseChan: make(chan *event, 100),
+		room:         room,
+	}
+}
+
+// sentCommands gets the commands a session sent to the server, such as "ban bob"
+func sentCommands(s *ircSession) []string {
+	var commands []string
+	for len(s.server.in) > 0 {
+		command := <-s.server.in
+		commands = append(commands, strings.Join(append([]string{command.command}, command.args...), " "))
+	}
+
+	return commands
+}
+
+// sentMessages gets the messages a session sent to the client
+func sentMessages(s *ircSession) []string {
+	var messages []string
+	for len(s.client.Send) > 0 {
+		messages = append(messages, strings.TrimSuffix(string(<-s.client.Send), "\r\n"))
+	}
+
+	return messages
+}
+
+func TestIRCSessionMode(t *testing.T) {
+	tests := []struct {
+		params   []string
+		commands []string
+		messages []string
+	}{
+		{[]string{"#lobby", "+o", "bob"}, []string{"op bob"}, nil},
+		{[]string{"#lobby", "-o", "bob"}, []string{"deop bob"}, nil},
+		{[]string{"#lobby", "+ob-b", "bob", "carol", "*.example.com"}, []string{"op bob", "ban carol", "unban *.example.com"}, nil},
+		{[]string{"#lobby", "+oo", "bob", "carol"}, []string{"op bob", "op carol"}, nil},
+		{[]string{"#lobby", "+b"}, []string{"bans"}, nil},
+		{[]string{"#lobby", "b"}, []string{"bans"}, nil},
+		{[]string{"#lobby", "+o"}, nil, nil}, // Nobody to op
+		{[]string{"#lobby", "+k", "secret"}, nil, []string{":chatsrv 472 alice k :is unknown mode char to me"}},
+		{[]string{"#lobby"}, nil, []string{":chatsrv 324 alice #lobby +"}},
+		{[]string{"#LOBBY", "+o", "bob"}, []string{"op bob"}, nil},
+		{[]string{"#other", "+o", "bob"}, nil, []string{":chatsrv 442 alice #other :You're not on that channel"}},
+		{[]string{"alice", "+i"}, nil, []string{":chatsrv 221 alice +"}},
+		{nil, nil, []string{":chatsrv 461 alice MODE :Not enough parameters"}},
+	}
+
+	for _, test := range tests {
+		s := newTestIRCSession("alice", "lobby")
+		s.mode(test.params)
+		if commands := sentCommands(s); !reflect.DeepEqual(commands, test.commands) {
+			t.Errorf("MODE %q sent commands %q, want %q", test.params, commands, test.commands)
+		}
+		if messages := sentMessages(s); !reflect.DeepEqual(messages, test.messages) {
+			t.Errorf("MODE %q sent messages %q, want %q", test.params, messages, test.messages)
+		}
+	}
+}
+
+func TestIRCSessionSendText(t *testing.T) {
+	tests := []struct {
+		command  string
+		target   string
+		text     string
+		commands []string
+		messages []string
+	}{
+		{"PRIVMSG", "#lobby", "Hello", []string{"say lobby Hello"}, nil},
+		{"PRIVMSG", "#lobby", "\x01ACTION waves\x01", []string{"me waves"}, nil},
+		{"PRIVMSG", "#lobby", "\x02bold\x02 text", []string{"say lobby bold text"}, nil},
+		{"PRIVMSG", "#lobby", "\x01VERSION\x01", nil, nil},
+		{"PRIVMSG", "bob", "Hi", []string{"msg bob Hi"}, nil},
+		{"PRIVMSG", "bob", "\x01ACTION waves\x01", []string{"msg bob * alice waves"}, nil},
+		{"PRIVMSG", "#other", "Hello", nil, []string{":chatsrv 404 alice #other :Cannot send to channel; you aren't in it"}},
+		{"NOTICE", "#other", "Hello", nil, nil},
+	}
+
+	for _, test := range tests {
+		s := newTestIRCSession("alice", "lobby")
+		s.sendText(test.command, test.target, test.text)
+		if commands := sentCommands(s); !reflect.DeepEqual(commands, test.commands) {
+			t.Errorf("%s %s %q sent commands %q, want %q", test.command, test.target, test.text, commands, test.commands)
+		}
+		if messages := sentMessages(s); !reflect.DeepEqual(messages, test.messages) {
+			t.Errorf("%s %s %q sent messages %q, want %q", test.command, test.target, test.text, messages, test.messages)
+		}
+	}
+}
+
+func TestIRCSessionListBans(t *testing.T) {
+	s := newTestIRCSession("alice", "lobby")
+	s.handleEvent(&event{Type: eventBans, Room: "lobby", Data: []banInfo{
+		{Nick: "bob", HostPattern: "192.0.2.1", SetBy: "alice"},
+		{HostPattern: "*.example.com", SetBy: "carol"},
+	}})
+
+	want := []string{
+		":chatsrv 367 alice #lobby bob alice",
+		":chatsrv 367 alice #lobby *.example.com carol",
+		":chatsrv 368 alice #lobby :End of channel ban list",
+	}
+	if messages := sentMessages(s); !reflect.DeepEqual(messages, want) {
+		t.Errorf("ban list sent %q, want %q", messages, want)
+	}
+}
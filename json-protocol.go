@@ -0,0 +1,90 @@
+package chatsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// Bots and other programs can switch to the JSON protocol with /protocol json.
+// Every event is then sent as a JSON object on a line of its own, such as:
+//
+//	{"type":"message","time":"2017-04-01T12:00:00Z","room":"lobby","from":"alice","body":"Hi","text":"alice: Hi\n"}
+//
+// and every line sent by the client must be a command object:
+//
+//	{"command":"join","args":["lobby"]}
+//
+// Commands are the same as the ones users type after a /,
+// except for "say", which says its args in the user's room, one line each.
+// {"command":"protocol","args":["text"]} switches back.
+
+// jsonCommand is a command sent by a client using the JSON protocol
+type jsonCommand struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// usesJSON returns true if the client switched to the JSON protocol
+func usesJSON(client *Client) bool {
+	protocol, _ := client.GetVar("protocol").(string)
+	return protocol == "json"
+}
+
+// formatEvent formats an event for a line-based client, in the protocol it is using.
+// Returns nil if the client shouldn't see the event.
+func formatEvent(client *Client, ev *event) []byte {
+	if !usesJSON(client) {
+		if ev.Text == "" || hideEvent(client, ev) {
+			return nil
+		}
+		if screenReader(client) {
+			return []byte(screenReaderText(client, ev))
+		}
+		if useColor(client) {
+			return []byte(styleEvent(client, ev))
+		}
+		return []byte(ev.Text)
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Cannot encode %s event as JSON: %s\n", ev.Type, err)
+		return nil
+	}
+
+	return append(data, '\n')
+}
+
+// parseJSONCommand reads a line sent by a client using the JSON protocol
+func parseJSONCommand(input string) (*jsonCommand, error) {
+	var command jsonCommand
+	if err := json.Unmarshal([]byte(input), &command); err != nil {
+		return nil, errors.Wrap(err, "Invalid JSON command")
+	}
+
+	command.Command = strings.TrimPrefix(command.Command, "/")
+	if command.Command == "" {
+		return nil, errors.New("No command specified")
+	}
+
+	return &command, nil
+}
+
+// cmdProtocol switches the client between the text and JSON protocols
+var cmdProtocol commandHandlerFunc = func(server *server, command *serverCommand) {
+	if len(command.args) < 1 || (command.args[0] != "text" && command.args[0] != "json") {
+		command.responseChan <- errorReply("Use /protocol text|json\nWith json, events are sent as JSON objects, one per line, and commands must be sent as JSON objects too.\n")
+		return
+	}
+	if transport, _ := command.client.GetVar("transport").(string); transport == "irc" {
+		command.responseChan <- errorReply("IRC clients can't change protocols.\n")
+		return
+	}
+
+	command.client.SetVar("protocol", command.args[0])
+	command.responseChan <- reply(fmt.Sprintf("Now using the %s protocol.\n", command.args[0]))
+}
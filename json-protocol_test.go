@@ -0,0 +1,169 @@
+package chatsrv
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseJSONCommand(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    *jsonCommand
+		wantErr bool
+	}{
+		{`{"command":"join","args":["lobby"]}`, &jsonCommand{Command: "join", Args: []string{"lobby"}}, false},
+		{`{"command":"/join","args":["lobby"]}`, &jsonCommand{Command: "join", Args: []string{"lobby"}}, false},
+		{`{"command":"say","args":["one","two"]}`, &jsonCommand{Command: "say", Args: []string{"one", "two"}}, false},
+		{`{"command":"users"}`, &jsonCommand{Command: "users"}, false},
+		{`{"command":"users","args":[]}`, &jsonCommand{Command: "users", Args: []string{}}, false},
+		{`{"command":"users","id":7,"extra":{"a":1}}`, &jsonCommand{Command: "users"}, false}, // Unknown fields are ignored
+		{` {"args":["lobby"],"command":"join"} `, &jsonCommand{Command: "join", Args: []string{"lobby"}}, false},
+		{`{"args":["lobby"]}`, nil, true},
+		{`{"command":"","args":["lobby"]}`, nil, true},
+		{`{"command":"/"}`, nil, true},
+		{`{}`, nil, true},
+		{`{"command":"join","args":"lobby"}`, nil, true},
+		{`{"command":"join","args":[1]}`, nil, true},
+		{`{"command":7}`, nil, true},
+		{`["join","lobby"]`, nil, true},
+		{`{"command":"join"`, nil, true},
+		{`/join lobby`, nil, true},
+		{``, nil, true},
+		{`null`, nil, true},
+	}
+
+	for _, test := range tests {
+		command, err := parseJSONCommand(test.input)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseJSONCommand(%s) = %+v, want an error", test.input, command)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseJSONCommand(%s): %s", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(command, test.want) {
+			t.Errorf("parseJSONCommand(%s) = %+v, want %+v", test.input, command, test.want)
+		}
+	}
+}
+
+func TestFormatEvent(t *testing.T) {
+	at := time.Date(2017, 4, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		ev   *event
+		text string // What a client using the text protocol is sent; "" if nothing
+		json string // What a client using the JSON protocol is sent
+	}{
+		{&event{Type: eventReply, Time: at, Text: "Done.\n"},
+			"Done.\n",
+			`{"type":"reply","time":"2017-04-01T12:00:00Z","text":"Done.\n"}`},
+		{&event{Type: eventError, Time: at, Text: "No such user.\n"},
+			"No such user.\n",
+			`{"type":"error","time":"2017-04-01T12:00:00Z","text":"No such user.\n"}`},
+		{&event{Type: eventWelcome, Time: at, To: "alice", Text: "Welcome, alice.\n"},
+			"Welcome, alice.\n",
+			`{"type":"welcome","time":"2017-04-01T12:00:00Z","to":"alice","text":"Welcome, alice.\n"}`},
+		{&event{Type: eventMessage, Time: at, Room: "lobby", From: "bob", Body: "Hi", Text: "bob: Hi\n"},
+			"bob: Hi\n",
+			`{"type":"message","time":"2017-04-01T12:00:00Z","room":"lobby","from":"bob","body":"Hi","text":"bob: Hi\n"}`},
+		{&event{Type: eventAction, Time: at, Room: "lobby", From: "bob", Body: "waves", Text: "bob waves\n"},
+			"bob waves\n",
+			`{"type":"action","time":"2017-04-01T12:00:00Z","room":"lobby","from":"bob","body":"waves","text":"bob waves\n"}`},
+		{&event{Type: eventPrivate, Time: at, From: "bob", To: "alice", Body: "psst", Text: "bob (private): psst\n"},
+			"bob (private): psst\n",
+			`{"type":"private","time":"2017-04-01T12:00:00Z","from":"bob","to":"alice","body":"psst","text":"bob (private): psst\n"}`},
+		{&event{Type: eventNotice, Time: at, Room: "lobby", Text: "The room is now logged.\n"},
+			"The room is now logged.\n",
+			`{"type":"notice","time":"2017-04-01T12:00:00Z","room":"lobby","text":"The room is now logged.\n"}`},
+		{&event{Type: eventJoin, Time: at, Room: "lobby", From: "bob", Text: "bob joined the room.\n"},
+			"bob joined the room.\n",
+			`{"type":"join","time":"2017-04-01T12:00:00Z","room":"lobby","from":"bob","text":"bob joined the room.\n"}`},
+		{&event{Type: eventJoined, Time: at, Room: "lobby", Text: "You joined lobby.\n", Data: &roomInfo{Name: "lobby", TopicSetAt: at, Size: 1, Members: []roomMember{{Nick: "alice", Mod: true}}}},
+			"You joined lobby.\n",
+			`{"type":"joined","time":"2017-04-01T12:00:00Z","room":"lobby","text":"You joined lobby.\n","data":{"name":"lobby","topic":"","topicSetAt":"2017-04-01T12:00:00Z","private":false,"permanent":false,"logged":false,"size":1,"members":[{"nick":"alice","mod":true}]}}`},
+		{&event{Type: eventLeave, Time: at, Room: "lobby", From: "bob", Body: "bye", Text: "bob left the room: bye\n"},
+			"bob left the room: bye\n",
+			`{"type":"leave","time":"2017-04-01T12:00:00Z","room":"lobby","from":"bob","body":"bye","text":"bob left the room: bye\n"}`},
+		{&event{Type: eventNick, Time: at, Room: "lobby", From: "bob", To: "robert", Text: "bob is now known as robert.\n"},
+			"bob is now known as robert.\n",
+			`{"type":"nick","time":"2017-04-01T12:00:00Z","room":"lobby","from":"bob","to":"robert","text":"bob is now known as robert.\n"}`},
+		{&event{Type: eventTopic, Time: at, Room: "lobby", From: "bob", Text: "bob removed the topic.\n"},
+			"bob removed the topic.\n",
+			`{"type":"topic","time":"2017-04-01T12:00:00Z","room":"lobby","from":"bob","text":"bob removed the topic.\n"}`},
+		{&event{Type: eventUsers, Time: at, Text: "bob\tlobby\n", Data: []userInfo{{Nick: "bob", Room: "lobby", LastSeen: at, Away: "lunch"}}},
+			"bob\tlobby\n",
+			`{"type":"users","time":"2017-04-01T12:00:00Z","text":"bob\tlobby\n","data":[{"nick":"bob","room":"lobby","mod":false,"lastSeen":"2017-04-01T12:00:00Z","away":"lunch"}]}`},
+		{&event{Type: eventRooms, Time: at, Text: "lobby\n", Data: []*roomInfo{{Name: "lobby", Topic: "Welcome", TopicSetBy: "bob", TopicSetAt: at, Private: true, Size: 2}}},
+			"lobby\n",
+			`{"type":"rooms","time":"2017-04-01T12:00:00Z","text":"lobby\n","data":[{"name":"lobby","topic":"Welcome","topicSetBy":"bob","topicSetAt":"2017-04-01T12:00:00Z","private":true,"permanent":false,"logged":false,"size":2}]}`},
+		{&event{Type: eventWhois, Time: at, Text: "bob is connected from 192.0.2.1.\n", Data: &whoisInfo{Nick: "bob", Host: "192.0.2.1", Transport: "telnet", LastSeen: at, WindowWidth: 80, WindowHeight: 24}},
+			"bob is connected from 192.0.2.1.\n",
+			`{"type":"whois","time":"2017-04-01T12:00:00Z","text":"bob is connected from 192.0.2.1.\n","data":{"nick":"bob","host":"192.0.2.1","transport":"telnet","lastSeen":"2017-04-01T12:00:00Z","dropped":0,"windowWidth":80,"windowHeight":24}}`},
+		{&event{Type: eventAudit, Time: at, Text: "kick\n", Data: []auditEntry{{Time: at, Action: "kick", Nick: "alice", Room: "lobby", Target: "bob"}}},
+			"kick\n",
+			`{"type":"audit","time":"2017-04-01T12:00:00Z","text":"kick\n","data":[{"time":"2017-04-01T12:00:00Z","action":"kick","nick":"alice","room":"lobby","target":"bob"}]}`},
+		{&event{Type: eventBans, Time: at, Room: "lobby", Text: "Bans in lobby:\n", Data: []banInfo{{HostPattern: "*.example.com", SetBy: "alice", Expires: at}}},
+			"Bans in lobby:\n",
+			`{"type":"bans","time":"2017-04-01T12:00:00Z","room":"lobby","text":"Bans in lobby:\n","data":[{"hostPattern":"*.example.com","setBy":"alice","expires":"2017-04-01T12:00:00Z"}]}`},
+		{&event{Type: eventAway, Time: at, From: "bob", Body: "lunch", Text: "bob is away: lunch\n"},
+			"bob is away: lunch\n",
+			`{"type":"away","time":"2017-04-01T12:00:00Z","from":"bob","body":"lunch","text":"bob is away: lunch\n"}`},
+		{&event{Type: eventBack, Time: at, Text: "You are no longer away.\n"},
+			"You are no longer away.\n",
+			`{"type":"back","time":"2017-04-01T12:00:00Z","text":"You are no longer away.\n"}`},
+
+		// Events without Text are only for clients that use the other fields
+		{&event{Type: eventBans, Time: at, Room: "lobby", Data: []banInfo{}},
+			"",
+			`{"type":"bans","time":"2017-04-01T12:00:00Z","room":"lobby","data":[]}`},
+	}
+
+	for _, test := range tests {
+		textClient := newTestClient(map[string]interface{}{"nick": "alice"})
+		if got := string(formatEvent(textClient, test.ev)); got != test.text {
+			t.Errorf("%s event as text = %q, want %q", test.ev.Type, got, test.text)
+		}
+
+		jsonClient := newTestClient(map[string]interface{}{"nick": "alice", "protocol": "json"})
+		if got := string(formatEvent(jsonClient, test.ev)); got != test.json+"\n" {
+			t.Errorf("%s event as JSON = %s, want %s", test.ev.Type, got, test.json)
+		}
+	}
+}
+
+func TestFormatEventOptions(t *testing.T) {
+	at := time.Date(2017, 4, 1, 12, 0, 0, 0, time.UTC)
+	join := &event{Type: eventJoin, Time: at, Room: "lobby", From: "bob", Text: "bob joined the room.\n"}
+	ownJoin := &event{Type: eventJoin, Time: at, Room: "lobby", From: "alice", Text: "alice joined the room.\n"}
+	message := &event{Type: eventMessage, Time: at, Room: "lobby", From: "bob", Body: "Hi", Text: "bob: Hi\n"}
+	tests := []struct {
+		name string
+		vars map[string]interface{}
+		ev   *event
+		want string
+	}{
+		{"quiet joins hide others joining", map[string]interface{}{"quiet_joins": true}, join, ""},
+		{"quiet joins show the user joining", map[string]interface{}{"quiet_joins": true}, ownJoin, "alice joined the room.\n"},
+		{"quiet joins don't hide JSON", map[string]interface{}{"quiet_joins": true, "protocol": "json"}, join,
+			`{"type":"join","time":"2017-04-01T12:00:00Z","room":"lobby","from":"bob","text":"bob joined the room.\n"}` + "\n"},
+		{"color", map[string]interface{}{"color": true}, join, styleLines(clientTheme(newTestClient(nil)).system, join.Text)},
+		{"color isn't used in JSON", map[string]interface{}{"color": true, "protocol": "json"}, message,
+			`{"type":"message","time":"2017-04-01T12:00:00Z","room":"lobby","from":"bob","body":"Hi","text":"bob: Hi\n"}` + "\n"},
+		{"screen reader", map[string]interface{}{"screen_reader": true, "color": true}, &event{Type: eventPrivate, From: "bob", To: "alice", Body: "psst", Text: "bob (private): psst\n"},
+			"Private message from bob: psst\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newTestClient(test.vars)
+			client.SetVar("nick", "alice")
+			if got := string(formatEvent(client, test.ev)); got != test.want {
+				t.Errorf("formatEvent = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
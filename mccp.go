@@ -0,0 +1,87 @@
+package chatsrv
+
+import (
+	"compress/zlib"
+	"fmt"
+)
+
+// MCCP2 compresses everything sent to a telnet client with zlib, once the client agrees.
+// The server marks where compression starts with IAC SB MCCP2 IAC SE.
+// Each write is flushed, so nothing waits in the compressor.
+
+// startCompression starts compressing output, after telling the client where it starts.
+func (t *telnetConn) startCompression() {
+	t.lockWriting()
+	defer t.unlockWriting()
+	if t.compressor != nil {
+		return
+	}
+
+	if _, err := t.conn.Write([]byte{telnetIAC, telnetSB, telnetOptMCCP2, telnetIAC, telnetSE}); err != nil {
+		return
+	}
+	t.compressor = zlib.NewWriter(compressedCounter{t})
+}
+
+// endCompression finishes the compressed stream, so the client can go back to reading plain output.
+// The caller must be holding t.writing.
+func (t *telnetConn) endCompression() {
+	if t.compressor == nil {
+		return
+	}
+
+	t.compressor.Close()
+	t.compressor = nil
+}
+
+// writeCompressed compresses p, and sends it to the client right away.
+// The caller must be holding t.writing.
+func (t *telnetConn) writeCompressed(p []byte) (int, error) {
+	if _, err := t.compressor.Write(p); err != nil {
+		return 0, err
+	}
+	if err := t.compressor.Flush(); err != nil {
+		return 0, err
+	}
+
+	t.lock.Lock()
+	t.uncompressedBytes += int64(len(p))
+	t.lock.Unlock()
+	return len(p), nil
+}
+
+// compressionStats returns how many bytes were sent with compression on, before and after compressing them.
+// Returns false if compression was never on.
+func (t *telnetConn) compressionStats() (int64, int64, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.uncompressedBytes, t.compressedBytes, t.compressedBytes > 0
+}
+
+// compressedCounter writes compressed output to the client, counting the bytes.
+type compressedCounter struct {
+	t *telnetConn
+}
+
+func (c compressedCounter) Write(p []byte) (int, error) {
+	n, err := c.t.conn.Write(p)
+	c.t.lock.Lock()
+	c.t.compressedBytes += int64(n)
+	c.t.lock.Unlock()
+	return n, err
+}
+
+// describeCompression says how well a telnet client's output has been compressed, such as "10240 bytes sent as 2048 (20%)".
+// Returns "" if the client's output isn't compressed.
+func describeCompression(client *Client) string {
+	t, ok := client.GetVar("telnet").(*telnetConn)
+	if !ok {
+		return ""
+	}
+	uncompressed, compressed, ok := t.compressionStats()
+	if !ok || uncompressed == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%d bytes sent as %d (%d%%)", uncompressed, compressed, compressed*100/uncompressed)
+}
@@ -0,0 +1,115 @@
+package chatsrv
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+var mccpStart = []byte{telnetIAC, telnetSB, telnetOptMCCP2, telnetIAC, telnetSE}
+
+// splitCompressed splits what was written to a client at the start of compression,
+// failing the test if compression wasn't started exactly once
+func splitCompressed(t *testing.T, written []byte) (before, compressed []byte) {
+	t.Helper()
+	i := bytes.Index(written, mccpStart)
+	if i < 0 {
+		t.Fatalf("compression wasn't started; wrote %v", written)
+	}
+	before, compressed = written[:i], written[i+len(mccpStart):]
+	if bytes.Contains(compressed, mccpStart) {
+		t.Fatal("compression was started twice")
+	}
+
+	return before, compressed
+}
+
+func TestTelnetConnCompression(t *testing.T) {
+	conn := &fakeConn{reads: [][]byte{{telnetIAC, telnetDO}, {telnetOptMCCP2, 'h', 'i'}}}
+	telnet := newTelnetConn(conn, true)
+	if _, _, ok := telnet.compressionStats(); ok {
+		t.Error("compression stats reported before compression started")
+	}
+	telnet.Write([]byte("before "))
+	if data := string(readAll(t, telnet)); data != "hi" {
+		t.Errorf("read %q, want \"hi\"", data)
+	}
+
+	// Asking again doesn't start another compressed stream
+	conn.reads = [][]byte{{telnetIAC, telnetDO, telnetOptMCCP2}}
+	readAll(t, telnet)
+
+	telnet.Write([]byte("compressed "))
+	telnet.Write([]byte("output"))
+	before, compressed := splitCompressed(t, conn.written.Bytes())
+	if string(before) != "before " {
+		t.Errorf("wrote %q before compressing, want \"before \"", before)
+	}
+
+	// Each write is flushed, so it can be read before the stream ends
+	want := "compressed output"
+	reader, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("compressed output has a bad header: %s", err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(reader, got); err != nil || string(got) != want {
+		t.Fatalf("decompressed %q (%v), want %q", got, err, want)
+	}
+	uncompressed, _, ok := telnet.compressionStats()
+	if !ok || uncompressed != int64(len(want)) {
+		t.Errorf("compression stats = %d uncompressed bytes, %v; want %d", uncompressed, ok, len(want))
+	}
+
+	// Closing ends the stream
+	telnet.Close()
+	if !conn.closed {
+		t.Error("connection wasn't closed")
+	}
+	_, compressed = splitCompressed(t, conn.written.Bytes())
+	reader, err = zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("compressed output has a bad header: %s", err)
+	}
+	if all, err := ioutil.ReadAll(reader); err != nil || string(all) != want {
+		t.Errorf("decompressed %q (%v) after closing, want %q and the end of the stream", all, err, want)
+	}
+}
+
+func TestTelnetConnCompressionEnds(t *testing.T) {
+	conn := &fakeConn{reads: [][]byte{{telnetIAC, telnetDO, telnetOptMCCP2}}}
+	telnet := newTelnetConn(conn, true)
+	readAll(t, telnet)
+	telnet.Write([]byte("compressed"))
+
+	conn.reads = [][]byte{{telnetIAC, telnetDONT, telnetOptMCCP2}}
+	readAll(t, telnet)
+	telnet.Write([]byte(" plain"))
+
+	// The compressed stream is finished, and what comes after it isn't compressed
+	_, rest := splitCompressed(t, conn.written.Bytes())
+	input := bytes.NewReader(rest)
+	reader, err := zlib.NewReader(input)
+	if err != nil {
+		t.Fatalf("compressed output has a bad header: %s", err)
+	}
+	if all, err := ioutil.ReadAll(reader); err != nil || string(all) != "compressed" {
+		t.Fatalf("decompressed %q (%v), want \"compressed\" and the end of the stream", all, err)
+	}
+	if plain, _ := ioutil.ReadAll(input); string(plain) != " plain" {
+		t.Errorf("wrote %q after compression ended, want \" plain\"", plain)
+	}
+}
+
+func TestTelnetConnAttachOffersCompression(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		conn := &fakeConn{}
+		newTelnetConn(conn, compress).attach(newTestClient(nil))
+		offered := bytes.Contains(conn.written.Bytes(), []byte{telnetIAC, telnetWILL, telnetOptMCCP2})
+		if offered != compress {
+			t.Errorf("with compress %v, MCCP2 offered: %v", compress, offered)
+		}
+	}
+}
@@ -0,0 +1,485 @@
+package chatsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Server operators look after the whole server: they can disconnect users, ban them from the server,
+// close rooms, and so on. Everything they do is written to the audit log.
+// Users become operators by logging into one of config.OperatorAccounts,
+// or with /oper and one of the names and passwords in config.Operators.
+// Operators are kept in the client's "oper" var, and the name they became an operator with in "oper_name".
+
+// isOper returns true if the client is a server operator
+func isOper(client *Client) bool {
+	oper, _ := client.GetVar("oper").(bool)
+	return oper
+}
+
+// requireOper returns true if the user who sent command is a server operator.
+// Otherwise, it tells them they aren't.
+func requireOper(command *serverCommand) bool {
+	if !isOper(command.client) {
+		command.responseChan <- errorReply("Only server operators can do that.\n")
+		return false
+	}
+
+	return true
+}
+
+// isOperAccount returns true if the client is logged into an account whose users are operators
+func isOperAccount(server *server, client *Client) bool {
+	account, ok := client.GetVar("account").(string)
+	if !ok {
+		return false
+	}
+	for _, operAccount := range server.config.OperatorAccounts {
+		if strings.EqualFold(operAccount, account) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// makeOper makes the user who sent command a server operator
+func makeOper(server *server, command *serverCommand, name, how string) {
+	command.client.SetVar("oper", true)
+	command.client.SetVar("oper_name", name)
+	server.audit(command, auditEntry{Action: "oper", Details: how})
+}
+
+// findUser finds a user on the server by nick, in any case.
+// Returns their nick, spelled the way they spell it, and their client.
+func findUser(server *server, nick string) (string, *Client, bool) {
+	client, ok := server.clients[strings.ToLower(nick)]
+	if !ok {
+		return "", nil, false
+	}
+	if current, ok := client.GetVar("nick").(string); ok {
+		nick = current
+	}
+
+	return nick, client, true
+}
+
+// disconnectUser tells a user why they are being disconnected, and removes them from the server.
+// reason is also shown to the room they were in.
+func disconnectUser(server *server, nick string, client *Client, reason string) {
+	responseChan := server.userResponseChan[nick]
+	if responseChan == nil {
+		return
+	}
+
+	responseChan <- errorReply(fmt.Sprintf("You were disconnected from the server. %s\n", reason))
+	cmdRmuser(server, &serverCommand{
+		nick:         nick,
+		client:       client,
+		responseChan: responseChan,
+		command:      "rmuser",
+		args:         []string{reason},
+	})
+}
+
+// findGlobalBan gets the first server-wide ban that applies to a user with the given nick and hosts.
+// Returns nil if there isn't one.
+func (server *server) findGlobalBan(nick string, hosts []string) *roomBan {
+	server.removeExpiredGlobalBans()
+	for _, ban := range server.bans {
+		if ban.matches(nick, hosts) {
+			return ban
+		}
+	}
+
+	return nil
+}
+
+// removeExpiredGlobalBans removes server-wide bans that have run out
+func (server *server) removeExpiredGlobalBans() {
+	bans := server.bans[:0]
+	for _, ban := range server.bans {
+		if !ban.expired() {
+			bans = append(bans, ban)
+		}
+	}
+	server.bans = bans
+}
+
+// LoadBans restores the server-wide bans saved in config.BansFile.
+// It must be called before the server is started.
+func (server *server) LoadBans() error {
+	if server.config.BansFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(server.config.BansFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Cannot read bans")
+	}
+
+	var persistedBans []persistedBan
+	if err := json.Unmarshal(data, &persistedBans); err != nil {
+		return errors.Wrapf(err, "Cannot parse bans in %s", server.config.BansFile)
+	}
+	for _, persisted := range persistedBans {
+		server.bans = append(server.bans, persisted.restore())
+	}
+	server.removeExpiredGlobalBans()
+	log.Printf("Loaded %d bans from %s\n", len(server.bans), server.config.BansFile)
+	return nil
+}
+
+// saveBans writes the server-wide bans to config.BansFile
+func (server *server) saveBans() {
+	if server.config.BansFile == "" {
+		return
+	}
+
+	server.removeExpiredGlobalBans()
+	persistedBans := make([]persistedBan, 0, len(server.bans))
+	for _, ban := range server.bans {
+		persistedBans = append(persistedBans, ban.persist())
+	}
+	data, err := json.MarshalIndent(persistedBans, "", "\t")
+	if err == nil {
+		err = writeFileAtomically(server.config.BansFile, data)
+	}
+	if err != nil {
+		log.Printf("Error saving bans: %s\n", err)
+	}
+}
+
+// cmdOper makes the user a server operator, if they know an operator's name and password
+var cmdOper commandHandlerFunc = func(server *server, command *serverCommand) {
+	if len(command.args) < 2 {
+		command.responseChan <- errorReply("Use /oper <name> <password>\n")
+		return
+	}
+	if isOper(command.client) {
+		command.responseChan <- errorReply("You are already a server operator.\n")
+		return
+	}
+
+	attempts, _ := command.client.GetVar("oper_attempts").(int)
+	if attempts >= maxPasswordAttempts {
+		command.responseChan <- errorReply("Too many wrong passwords; reconnect to try again.\n")
+		return
+	}
+	command.client.SetVar("oper_attempts", attempts+1)
+
+	name, password := command.args[0], command.args[1]
+	var hash string
+	for operName, operHash := range server.config.Operators {
+		if strings.EqualFold(operName, name) {
+			name, hash = operName, operHash
+		}
+	}
+	if hash == "" {
+		server.audit(command, auditEntry{Action: "oper-failed", Details: fmt.Sprintf("No operator named %s", name)})
+		command.responseChan <- errorReply("Wrong name or password.\n")
+		return
+	}
+
+	// Checking the password is slow, so it's done outside of the server's goroutine
+	go func() {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			server.audit(command, auditEntry{Action: "oper-failed", Details: fmt.Sprintf("Wrong password for %s", name)})
+			notifyLater(server, command, "Wrong name or password.\n")
+			return
+		}
+
+		command.client.SetVar("oper_attempts", 0)
+		makeOper(server, command, name, "Gave an operator password")
+		notifyLater(server, command, "You are now a server operator.\n")
+	}()
+}
+
+// cmdKill disconnects a user from the server
+var cmdKill commandHandlerFunc = func(server *server, command *serverCommand) {
+	if !requireOper(command) {
+		return
+	}
+	if len(command.args) < 1 {
+		command.responseChan <- errorReply("Use /kill <nick> [<reason>]\n")
+		return
+	}
+
+	nick, client, ok := findUser(server, command.args[0])
+	if !ok {
+		command.responseChan <- errorReply("That user doesn't exist.\n")
+		return
+	}
+
+	reason := strings.Join(command.args[1:], " ")
+	message := fmt.Sprintf("Killed by %s", command.nick)
+	if reason != "" {
+		message += ": " + reason
+	}
+
+	server.audit(command, auditEntry{Action: "kill", Target: nick, Details: reason})
+	// Reply first, in case operators kill themselves
+	command.responseChan <- reply(fmt.Sprintf("Disconnected %s.\n", nick))
+	disconnectUser(server, nick, client, message)
+}
+
+// cmdWall sends a message to everyone on the server
+var cmdWall commandHandlerFunc = func(server *server, command *serverCommand) {
+	if !requireOper(command) {
+		return
+	}
+	if len(command.args) < 1 {
+		command.responseChan <- errorReply("Use /wall <message>\n")
+		return
+	}
+
+	message := strings.Join(command.args, " ")
+	server.audit(command, auditEntry{Action: "wall", Details: message})
+	ev := &event{
+		Type: eventNotice,
+		Time: time.Now(),
+		From: command.nick,
+		Body: message,
+		Text: fmt.Sprintf("Announcement from %s: %s", command.nick, formatMessage(message)),
+	}
+	for _, responseChan := range server.userResponseChan {
+		responseChan <- ev
+	}
+}
+
+// cmdGban bans a user or host pattern from the whole server
+var cmdGban commandHandlerFunc = func(server *server, command *serverCommand) {
+	if !requireOper(command) {
+		return
+	}
+	if len(command.args) < 1 {
+		command.responseChan <- errorReply("Use /gban <nick|host-pattern> [<duration>] [<reason>]\nDurations look like 30m or 2h; bans without one last until they are removed with /gunban.\nPatterns of host names match users once their host names have been looked up, which can be shortly after they connect.\n")
+		return
+	}
+
+	ban, ok := parseBan(server, command)
+	if !ok {
+		return
+	}
+	if _, client, online := findUser(server, ban.nick); online && isOper(client) {
+		command.responseChan <- errorReply("You can't ban a server operator.\n")
+		return
+	}
+
+	server.bans = append(server.bans, ban)
+	server.saveBans()
+	server.audit(command, auditEntry{Action: "gban", Target: ban.target(), Details: strings.TrimSpace(describeExpiry(ban.expires) + " " + ban.reason)})
+	command.responseChan <- reply(fmt.Sprintf("Banned %s from the server%s\n", ban, describeExpiry(ban.expires)))
+
+	// Disconnect anyone the ban applies to
+	message := fmt.Sprintf("Banned from the server by %s", command.nick)
+	if ban.reason != "" {
+		message += ": " + ban.reason
+	}
+	for _, client := range server.clients {
+		nick, _ := client.GetVar("nick").(string)
+		if !isOper(client) && ban.matches(nick, clientHosts(client)) {
+			// Removing users from server.clients while ranging over it is safe
+			disconnectUser(server, nick, client, message)
+		}
+	}
+}
+
+// cmdGunban removes server-wide bans on a nick or host pattern
+var cmdGunban commandHandlerFunc = func(server *server, command *serverCommand) {
+	if !requireOper(command) {
+		return
+	}
+	if len(command.args) < 1 {
+		command.responseChan <- errorReply("Use /gunban <nick|host-pattern>\n/gbans lists the server's bans.\n")
+		return
+	}
+
+	target := command.args[0]
+	bans := server.bans[:0]
+	removed := 0
+	for _, ban := range server.bans {
+		if strings.EqualFold(ban.nick, target) || (ban.hostPattern != "" && strings.EqualFold(ban.hostPattern, target)) {
+			removed++
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	server.bans = bans
+
+	if removed == 0 {
+		command.responseChan <- errorReply("No bans match that.\n")
+		return
+	}
+
+	server.saveBans()
+	server.audit(command, auditEntry{Action: "gunban", Target: target})
+	command.responseChan <- reply(fmt.Sprintf("Removed %d %s.\n", removed, plural(removed, "ban", "bans")))
+}
+
+// cmdGbans lists the server's bans
+var cmdGbans commandHandlerFunc = func(server *server, command *serverCommand) {
+	if !requireOper(command) {
+		return
+	}
+
+	server.removeExpiredGlobalBans()
+	if len(server.bans) == 0 {
+		command.responseChan <- reply("Nobody is banned from the server.\n")
+		return
+	}
+
+	response := make([]string, 0, len(server.bans)+1)
+	response = append(response, "Server bans:")
+	for _, ban := range server.bans {
+		line := fmt.Sprintf("%s%s", ban, describeExpiry(ban.expires))
+		if ban.reason != "" {
+			line += fmt.Sprintf(": %s", ban.reason)
+		}
+		response = append(response, line)
+	}
+
+	command.responseChan <- reply(strings.Join(response, "\n") + "\n")
+}
+
+// cmdCloseroom removes everyone from a room, and closes it, even if it is permanent
+var cmdCloseroom commandHandlerFunc = func(server *server, command *serverCommand) {
+	if !requireOper(command) {
+		return
+	}
+	if len(command.args) < 1 {
+		command.responseChan <- errorReply("Use /closeroom <room> [<reason>]\n")
+		return
+	}
+
+	room, ok := server.rooms[strings.ToLower(command.args[0])]
+	if !ok {
+		command.responseChan <- errorReply("That room doesn't exist.\n")
+		return
+	}
+
+	reason := strings.Join(command.args[1:], " ")
+	server.audit(command, auditEntry{Action: "closeroom", Room: room.name, Details: reason})
+
+	server.roomChanged(room) // Before it stops being persistent, so it is removed from the saved rooms
+	room.persistent = false
+	members := make([]string, 0, len(room.mods)+len(room.users))
+	for nick := range room.mods {
+		members = append(members, nick)
+	}
+	for nick := range room.users {
+		members = append(members, nick)
+	}
+	for _, nick := range members {
+		kickFromRoom(server, room, nick, fmt.Sprintf("Room closed by %s", command.nick), reason)
+	}
+
+	// Rooms are closed when their last member leaves, but the room might have been empty
+	deleteRoom(server, room)
+	command.responseChan <- reply(fmt.Sprintf("Closed %s.\n", room.name))
+}
+
+// cmdForcenick changes another user's nick
+var cmdForcenick commandHandlerFunc = func(server *server, command *serverCommand) {
+	if !requireOper(command) {
+		return
+	}
+	if len(command.args) < 2 {
+		command.responseChan <- errorReply("Use /forcenick <nick> <newnick>\n")
+		return
+	}
+
+	nick, client, ok := findUser(server, command.args[0])
+	if !ok {
+		command.responseChan <- errorReply("That user doesn't exist.\n")
+		return
+	}
+
+	// Check the new nick here, so the operator is told what's wrong with it, rather than the user
+	newNick := command.args[1]
+	if !isValidNick(newNick) {
+		command.responseChan <- errorReply("Nicks can contain only letters and numbers\n")
+		return
+	}
+	if _, taken := server.clients[strings.ToLower(newNick)]; taken {
+		command.responseChan <- errorReply("That nick is already taken.\n")
+		return
+	}
+	if store := server.config.AccountStore; store != nil {
+		account, err := store.Account(newNick)
+		loggedInAs, _ := client.GetVar("account").(string)
+		if err == nil && !strings.EqualFold(loggedInAs, account.Nick) {
+			command.responseChan <- errorReply("That nick is registered to someone else.\n")
+			return
+		} else if err != nil && err != ErrNoAccount {
+			log.Printf("Error looking up account for %s: %s\n", newNick, err)
+			command.responseChan <- errorReply("Cannot check if that nick is registered; try again later.\n")
+			return
+		}
+	}
+
+	server.audit(command, auditEntry{Action: "forcenick", Target: nick, Details: newNick})
+	responseChan := server.userResponseChan[nick]
+	responseChan <- reply(fmt.Sprintf("%s changed your nick.\n", command.nick))
+	cmdNick(server, &serverCommand{
+		nick:         nick,
+		client:       client,
+		responseChan: responseChan,
+		command:      "nick",
+		args:         []string{newNick},
+	})
+	if nick != command.nick {
+		command.responseChan <- reply(fmt.Sprintf("Changed the nick of %s to %s.\n", nick, newNick))
+	}
+}
+
+// cmdSajoin moves a user into a room, even if it is private or they are banned from it
+var cmdSajoin commandHandlerFunc = func(server *server, command *serverCommand) {
+	if !requireOper(command) {
+		return
+	}
+	if len(command.args) < 2 {
+		command.responseChan <- errorReply("Use /sajoin <nick> <room>\nThe user is moved even if the room is private, or they are banned from it.\n")
+		return
+	}
+
+	nick, client, ok := findUser(server, command.args[0])
+	if !ok {
+		command.responseChan <- errorReply("That user doesn't exist.\n")
+		return
+	}
+	room, ok := server.rooms[strings.ToLower(command.args[1])]
+	if !ok {
+		command.responseChan <- errorReply("That room doesn't exist.\n")
+		return
+	}
+	if server.userActiveRoom[nick] == room.name {
+		command.responseChan <- errorReply("They are already in that room.\n")
+		return
+	}
+
+	server.audit(command, auditEntry{Action: "sajoin", Target: nick, Room: room.name})
+	responseChan := server.userResponseChan[nick]
+	responseChan <- reply(fmt.Sprintf("%s moved you to %s.\n", command.nick, room.name))
+	joinRoom(server, &serverCommand{
+		nick:         nick,
+		client:       client,
+		responseChan: responseChan,
+		command:      "join",
+		args:         []string{room.name},
+	}, room)
+	if nick != command.nick {
+		command.responseChan <- reply(fmt.Sprintf("Moved %s to %s.\n", nick, room.name))
+	}
+}
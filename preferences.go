@@ -0,0 +1,140 @@
+package chatsrv
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Preferences are settings users choose for themselves.
+// They are kept in client vars while the user is connected,
+// and saved with the user's account, if they are logged into one.
+type Preferences struct {
+	Color        *bool  `json:",omitempty"` // nil until the user turns colors on or off with /color
+	Theme        string `json:",omitempty"`
+	ScreenReader bool   `json:",omitempty"`
+	QuietJoins   bool   `json:",omitempty"` // Don't show people joining and leaving rooms
+	AnnounceAway bool   `json:",omitempty"` // Tell the user's room when they go away and come back
+}
+
+// modes users can turn on and off with /mode, and the client vars they are kept in
+var modes = []struct {
+	name        string
+	variable    string
+	description string
+}{
+	{"screenreader", "screen_reader", "Listings are read as sentences, multiline messages say how many lines they have, and colors are off"},
+	{"quiet", "quiet_joins", "People joining and leaving rooms aren't shown"},
+	{"announceaway", "announce_away", "Your room is told when you go away and come back"},
+}
+
+// loadPreferences puts the user's preferences into the client's vars
+func loadPreferences(client *Client, prefs Preferences) {
+	if prefs.Color != nil {
+		client.SetVar("color", *prefs.Color)
+	}
+	if prefs.Theme != "" {
+		client.SetVar("theme", prefs.Theme)
+	}
+	client.SetVar("screen_reader", prefs.ScreenReader)
+	client.SetVar("quiet_joins", prefs.QuietJoins)
+	client.SetVar("announce_away", prefs.AnnounceAway)
+}
+
+// clientPreferences gets the user's preferences from the client's vars
+func clientPreferences(client *Client) Preferences {
+	var prefs Preferences
+	if color, ok := client.GetVar("color").(bool); ok {
+		prefs.Color = &color
+	}
+	prefs.Theme, _ = client.GetVar("theme").(string)
+	prefs.ScreenReader, _ = client.GetVar("screen_reader").(bool)
+	prefs.QuietJoins, _ = client.GetVar("quiet_joins").(bool)
+	prefs.AnnounceAway, _ = client.GetVar("announce_away").(bool)
+	return prefs
+}
+
+// loadAccountPreferences loads the preferences saved with the account the client is logged into, if there is one
+func loadAccountPreferences(server *server, client *Client) {
+	accountNick, ok := client.GetVar("account").(string)
+	store := server.config.AccountStore
+	if !ok || store == nil {
+		return
+	}
+
+	account, err := store.Account(accountNick)
+	if err != nil {
+		log.Printf("Error loading preferences for %s: %s\n", accountNick, err)
+		return
+	}
+	loadPreferences(client, account.Preferences)
+}
+
+// savePreferences saves the user's preferences with their account, if they are logged into one.
+// The account is saved in the background, so the server isn't held up writing it.
+func savePreferences(server *server, command *serverCommand) {
+	accountNick, ok := command.client.GetVar("account").(string)
+	store := server.config.AccountStore
+	if !ok || store == nil {
+		return
+	}
+
+	go func() {
+		// The preferences are read while the account is locked,
+		// so if the user changes them again meanwhile, the latest ones are saved last.
+		err := store.UpdateAccount(accountNick, func(account *Account) error {
+			account.Preferences = clientPreferences(command.client)
+			return nil
+		})
+		if err != nil {
+			log.Printf("Error saving preferences for %s: %s\n", accountNick, err)
+			notifyLater(server, command, "Cannot save your preferences right now; they will only last until you disconnect.\n")
+		}
+	}()
+}
+
+// cmdMode lists the user's modes, or turns one on or off
+var cmdMode commandHandlerFunc = func(server *server, command *serverCommand) {
+	if len(command.args) < 1 {
+		response := make([]string, 0, len(modes)+2)
+		response = append(response, "Modes:")
+		for _, mode := range modes {
+			state := "off"
+			if on, _ := command.client.GetVar(mode.variable).(bool); on {
+				state = "on"
+			}
+			response = append(response, fmt.Sprintf("%s is %s: %s.", mode.name, state, mode.description))
+		}
+		response = append(response, "Use /mode <name> on|off to change one.")
+		command.responseChan <- reply(strings.Join(response, "\n") + "\n")
+		return
+	}
+
+	name := strings.ToLower(command.args[0])
+	on := true
+	if len(command.args) >= 2 {
+		if command.args[1] != "on" && command.args[1] != "off" {
+			command.responseChan <- errorReply("Use /mode <name> on|off\n/mode lists the modes.\n")
+			return
+		}
+		on = command.args[1] == "on"
+	}
+
+	for _, mode := range modes {
+		if mode.name != name {
+			continue
+		}
+
+		command.client.SetVar(mode.variable, on)
+		savePreferences(server, command)
+		if on {
+			command.responseChan <- reply(fmt.Sprintf("Turned on %s mode. %s.\n", mode.name, mode.description))
+		} else {
+			command.responseChan <- reply(fmt.Sprintf("Turned off %s mode.\n", mode.name))
+		}
+		return
+	}
+
+	command.responseChan <- errorReply("There is no mode by that name; /mode lists them.\n")
+}
@@ -0,0 +1,200 @@
+package chatsrv
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Number of lookups that can wait for a worker; addresses that come in while the queue is full aren't looked up
+const hostResolverQueueSize = 100
+
+// hostResolver looks up the host names of addresses in the background, with a few workers,
+// so a slow DNS server can't hold up anything else.
+// A host name is only believed if it resolves back to the address (forward-confirmed reverse DNS);
+// otherwise, anyone controlling the reverse zone of their address could claim to be any host.
+// Results, including failures, are cached for a while.
+type hostResolver struct {
+	requests chan hostLookup
+	timeout  time.Duration
+
+	lock      sync.Mutex // protects everything below
+	cache     map[string]*list.Element
+	lru       *list.List // Cached hosts, most recently used first
+	cacheSize int
+	ttl       time.Duration
+}
+
+// hostLookup asks for the host name of an address
+type hostLookup struct {
+	addr string
+	done func(host string) // Called with the host name, or "" if there isn't a confirmed one
+}
+
+// cachedHost is a cached host name, or "" if the address had no confirmed host name
+type cachedHost struct {
+	addr    string
+	host    string
+	expires time.Time
+}
+
+// newHostResolver starts workers goroutines that look up host names.
+// Lookups give up after timeout, and up to cacheSize results are kept for ttl.
+func newHostResolver(workers int, timeout time.Duration, cacheSize int, ttl time.Duration) *hostResolver {
+	r := &hostResolver{
+		requests:  make(chan hostLookup, hostResolverQueueSize),
+		timeout:   timeout,
+		cache:     make(map[string]*list.Element),
+		lru:       list.New(),
+		cacheSize: cacheSize,
+		ttl:       ttl,
+	}
+	for i := 0; i < workers; i++ {
+		go r.work()
+	}
+
+	return r
+}
+
+// resolve looks up the host name of addr, and calls done with it, or with "" if there isn't a confirmed one.
+// done is called right away if the host name is cached, and from another goroutine otherwise.
+// If too many lookups are waiting, addr isn't looked up, and done is never called.
+func (r *hostResolver) resolve(addr string, done func(host string)) {
+	if host, ok := r.cached(addr); ok {
+		done(host)
+		return
+	}
+
+	select {
+	case r.requests <- hostLookup{addr, done}:
+	default:
+		log.Printf("Too many host name lookups waiting; not looking up %s\n", addr)
+	}
+}
+
+func (r *hostResolver) work() {
+	for request := range r.requests {
+		// Another worker might have looked up the same address while this one was waiting
+		host, ok := r.cached(request.addr)
+		if !ok {
+			host = r.lookup(request.addr)
+			r.store(request.addr, host)
+		}
+		request.done(host)
+	}
+}
+
+// lookup gets the host name of addr, if one of its names resolves back to it
+func (r *hostResolver) lookup(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, addr)
+	if err != nil {
+		// No need to report errors; most addresses don't have names
+		return ""
+	}
+
+	for _, name := range names {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if a.IP.Equal(ip) {
+				return strings.TrimSuffix(name, ".")
+			}
+		}
+	}
+
+	return ""
+}
+
+// cached gets the cached host name for addr, if there is one that hasn't expired
+func (r *hostResolver) cached(addr string) (string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	element, ok := r.cache[addr]
+	if !ok {
+		return "", false
+	}
+
+	entry := element.Value.(*cachedHost)
+	if time.Now().After(entry.expires) {
+		r.lru.Remove(element)
+		delete(r.cache, addr)
+		return "", false
+	}
+
+	r.lru.MoveToFront(element)
+	return entry.host, true
+}
+
+// store caches the host name of addr, making room by forgetting the least recently used one if the cache is full
+func (r *hostResolver) store(addr, host string) {
+	if r.cacheSize <= 0 {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry := &cachedHost{addr: addr, host: host, expires: time.Now().Add(r.ttl)}
+	if element, ok := r.cache[addr]; ok {
+		element.Value = entry
+		r.lru.MoveToFront(element)
+		return
+	}
+
+	r.cache[addr] = r.lru.PushFront(entry)
+	if r.lru.Len() > r.cacheSize {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.cache, oldest.Value.(*cachedHost).addr)
+	}
+}
+
+// describeHost describes where a client connected from, such as "host.example.com (192.0.2.1)",
+// or just the address if it has no confirmed host name.
+func describeHost(client *Client) string {
+	addr, _ := client.GetVar("remote_addr").(string)
+	host, _ := client.GetVar("remote_host").(string)
+	if host == "" {
+		return addr
+	}
+
+	return fmt.Sprintf("%s (%s)", host, addr)
+}
+
+// cmdHostfound checks the bans on host patterns again once a user's host name has been found,
+// disconnecting them if they are banned from the server, and removing them from their room if they are banned from it.
+// Users can get on the server, and into a room, before the lookup finishes.
+var cmdHostfound commandHandlerFunc = func(server *server, command *serverCommand) {
+	hosts := clientHosts(command.client)
+	if ban := server.findGlobalBan(command.nick, hosts); ban != nil && !isOper(command.client) {
+		message := fmt.Sprintf("Banned from the server by %s", ban.setBy)
+		if ban.reason != "" {
+			message += ": " + ban.reason
+		}
+		log.Printf("Disconnected %s (%s): banned from the server\n", command.nick, command.client)
+		disconnectUser(server, command.nick, command.client, message)
+		return
+	}
+
+	room, ok := getActiveRoom(server, command.nick)
+	if !ok {
+		return
+	}
+	if ban := room.findBan(command.nick, hosts); ban != nil {
+		kickFromRoom(server, room, command.nick, fmt.Sprintf("Banned by %s", ban.setBy), ban.reason)
+	}
+}
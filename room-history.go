@@ -0,0 +1,114 @@
+package chatsrv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyLine is something that was said in a room
+type historyLine struct {
+	time time.Time
+	text string
+}
+
+// String formats the line with a timestamp, for example "[14:05] alice: hi".
+// Lines from before today include the date.
+func (line historyLine) String() string {
+	layout := "15:04"
+	if y, m, d := line.time.Date(); time.Now().Year() != y || time.Now().Month() != m || time.Now().Day() != d {
+		layout = "Jan 2 15:04"
+	}
+
+	return fmt.Sprintf("[%s] %s", line.time.Format(layout), line.text)
+}
+
+// roomHistory remembers the most recent lines said in a room.
+// Once full, the oldest lines are overwritten.
+type roomHistory struct {
+	lines []historyLine // Ring buffer
+	next  int           // Where the next line will go
+	count int           // Number of lines in the buffer
+}
+
+func newRoomHistory(size int) *roomHistory {
+	if size < 0 {
+		size = 0
+	}
+
+	return &roomHistory{lines: make([]historyLine, size)}
+}
+
+// add remembers a line
+func (history *roomHistory) add(text string) {
+	if len(history.lines) == 0 {
+		return
+	}
+
+	history.lines[history.next] = historyLine{time: time.Now(), text: text}
+	history.next = (history.next + 1) % len(history.lines)
+	if history.count < len(history.lines) {
+		history.count++
+	}
+}
+
+// last returns up to n of the most recent lines, oldest first
+func (history *roomHistory) last(n int) []historyLine {
+	if n > history.count {
+		n = history.count
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	lines := make([]historyLine, n)
+	start := history.next - n
+	if start < 0 {
+		start += len(history.lines)
+	}
+	for i := range lines {
+		lines[i] = history.lines[(start+i)%len(history.lines)]
+	}
+
+	return lines
+}
+
+// formatHistory formats lines to be sent to a user, under a header
+func formatHistory(header string, lines []historyLine) string {
+	response := make([]string, 0, len(lines)+1)
+	response = append(response, header)
+	for _, line := range lines {
+		// Indent continuation lines of multiline messages
+		response = append(response, strings.Replace(line.String(), "\n", "\n    ", -1))
+	}
+
+	return strings.Join(response, "\n") + "\n"
+}
+
+// cmdHistory shows what was said recently in the room
+var cmdHistory commandHandlerFunc = func(server *server, command *serverCommand) {
+	room, ok := getActiveRoom(server, command.nick)
+	if !ok {
+		command.responseChan <- errorReply("You must be in a room to do that.\n")
+		return
+	}
+
+	count := server.config.HistoryReplayLines
+	if len(command.args) >= 1 {
+		n, err := strconv.Atoi(command.args[0])
+		if err != nil || n < 1 {
+			command.responseChan <- errorReply("Use /history [<count>]\n")
+			return
+		}
+		count = n
+	}
+
+	lines := room.history.last(count)
+	if len(lines) == 0 {
+		command.responseChan <- reply("Nothing has been said here yet.\n")
+		return
+	}
+
+	command.responseChan <- reply(formatHistory(fmt.Sprintf("Last %d %s in %s:", len(lines), plural(len(lines), "line", "lines"), room.name), lines))
+}
@@ -0,0 +1,243 @@
+package chatsrv
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// How often files from previous days are looked for and closed
+const roomLogCheckInterval = time.Hour
+
+// roomLogger writes what is said in rooms to files.
+// Each room gets a directory, containing a file per day named like lobby-2017-04-01.log.
+// When a file grows past maxSize, it is moved aside (lobby-2017-04-01.1.log), and a new one is started.
+// Files that are no longer written to can be compressed with gzip.
+// Files from previous days are closed every roomLogCheckInterval, even if their rooms went quiet.
+// It must only be used from the goroutine running acceptCommands.
+type roomLogger struct {
+	dir      string
+	maxSize  int64 // 0 is unlimited
+	compress bool
+	files    map[string]*roomLogFile // Open files, keyed by lowercase room name
+}
+
+// roomLogFile is the file a room is currently being logged to
+type roomLogFile struct {
+	file *os.File
+	day  string // Day the file is for, as 2006-01-02
+	size int64
+}
+
+func newRoomLogger(dir string, maxSize int64, compress bool) *roomLogger {
+	return &roomLogger{
+		dir:      dir,
+		maxSize:  maxSize,
+		compress: compress,
+		files:    make(map[string]*roomLogFile),
+	}
+}
+
+// log writes a timestamped message to a room's log.
+// Lines after the first are indented, like they are when sent to users.
+func (logger *roomLogger) log(roomName, message string) {
+	now := time.Now()
+	line := fmt.Sprintf("[%s] %s\n", now.Format("2006-01-02 15:04:05"), strings.Replace(message, "\n", "\n    ", -1))
+
+	logFile, err := logger.file(roomName, now, int64(len(line)))
+	if err != nil {
+		log.Printf("Error opening log for room %s: %s\n", roomName, err)
+		return
+	}
+
+	n, err := io.WriteString(logFile.file, line)
+	logFile.size += int64(n)
+	if err != nil {
+		log.Printf("Error writing log for room %s: %s\n", roomName, err)
+	}
+}
+
+// file gets the file to log n more bytes to, rotating the room's current file if needed
+func (logger *roomLogger) file(roomName string, now time.Time, n int64) (*roomLogFile, error) {
+	key := strings.ToLower(roomName)
+	day := now.Format("2006-01-02")
+	logFile, ok := logger.files[key]
+	if ok && logFile.day == day && (logger.maxSize <= 0 || logFile.size == 0 || logFile.size+n <= logger.maxSize) {
+		return logFile, nil
+	}
+
+	if ok {
+		// A new day started, or the file got too big
+		logger.closeFile(key)
+		if logFile.day == day {
+			if err := logger.moveAside(roomName, day); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	path := logger.path(roomName, day, 0)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.Wrap(err, "Cannot create log directory")
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot open log file")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "Cannot open log file")
+	}
+
+	logFile = &roomLogFile{file: file, day: day, size: info.Size()}
+	logger.files[key] = logFile
+	return logFile, nil
+}
+
+// moveAside renames a room's log file for a day, so a new one can be started.
+// It gets the first free number, such as lobby-2017-04-01.3.log.
+func (logger *roomLogger) moveAside(roomName, day string) error {
+	for i := 1; ; i++ {
+		path := logger.path(roomName, day, i)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if _, err := os.Stat(path + ".gz"); err == nil {
+			continue
+		}
+
+		if err := os.Rename(logger.path(roomName, day, 0), path); err != nil {
+			return errors.Wrap(err, "Cannot rotate log file")
+		}
+		logger.compressLater(path)
+		return nil
+	}
+}
+
+// path gets the path of a room's log file for a day.
+// If i is greater than 0, it gets the path of the ith file that was moved aside.
+func (logger *roomLogger) path(roomName, day string, i int) string {
+	name := fmt.Sprintf("%s-%s.log", strings.ToLower(roomName), day)
+	if i > 0 {
+		name = fmt.Sprintf("%s-%s.%d.log", strings.ToLower(roomName), day, i)
+	}
+
+	return filepath.Join(logger.dir, strings.ToLower(roomName), name)
+}
+
+// closeFile closes a room's current log file.
+// If it's from a previous day, it is compressed.
+func (logger *roomLogger) closeFile(key string) {
+	logFile, ok := logger.files[key]
+	if !ok {
+		return
+	}
+
+	delete(logger.files, key)
+	if err := logFile.file.Close(); err != nil {
+		log.Printf("Error closing log file %s: %s\n", logFile.file.Name(), err)
+	}
+	if logFile.day != time.Now().Format("2006-01-02") {
+		logger.compressLater(logFile.file.Name())
+	}
+}
+
+// closeOldFiles closes the files of rooms that haven't been logged to since a previous day, compressing them
+func (logger *roomLogger) closeOldFiles() {
+	today := time.Now().Format("2006-01-02")
+	for key, logFile := range logger.files {
+		if logFile.day != today {
+			logger.closeFile(key)
+		}
+	}
+}
+
+// close closes all open log files.
+func (logger *roomLogger) close() {
+	for key := range logger.files {
+		logger.closeFile(key)
+	}
+}
+
+// compressLater gzips a log file in the background, if compression is enabled.
+func (logger *roomLogger) compressLater(path string) {
+	if !logger.compress {
+		return
+	}
+
+	go func() {
+		if err := gzipFile(path); err != nil {
+			log.Printf("Error compressing log file %s: %s\n", path, err)
+		}
+	}()
+}
+
+// gzipFile compresses the file at path to path.gz, and removes the original.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// cmdLog turns logging on or off for the room
+var cmdLog commandHandlerFunc = func(server *server, command *serverCommand) {
+	if server.roomLogger == nil {
+		command.responseChan <- errorReply("Logging isn't enabled on this server.\n")
+		return
+	}
+	if len(command.args) < 1 || (command.args[0] != "on" && command.args[0] != "off") {
+		command.responseChan <- errorReply("Use /log on|off\nWhen logging is on, everything said in the room is saved on the server.\n")
+		return
+	}
+
+	room, ok := getModeratedRoom(server, command)
+	if !ok {
+		return
+	}
+
+	logging := command.args[0] == "on"
+	if logging == room.logging {
+		command.responseChan <- errorReply(fmt.Sprintf("Logging is already %s.\n", command.args[0]))
+		return
+	}
+
+	if logging {
+		room.logging = true
+		sayToRoom(server, room.name, fmt.Sprintf("%s turned on logging; everything said in this room will be saved", command.nick))
+	} else {
+		sayToRoom(server, room.name, fmt.Sprintf("%s turned off logging", command.nick))
+		room.logging = false
+		server.roomLogger.closeFile(strings.ToLower(room.name))
+	}
+	server.roomChanged(room)
+}
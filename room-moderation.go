@@ -0,0 +1,428 @@
+package chatsrv
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// roomBan keeps someone out of a room.
+// A ban matches a user by nick, or by a host pattern checked against their address,
+// so a banned user can't get back in by reconnecting with a different nick.
+type roomBan struct {
+	nick        string // Banned nick; "" if only banned by host
+	hostPattern string // Pattern in path.Match syntax, such as *.example.com; "" if only banned by nick
+	setBy       string
+	reason      string
+	expires     time.Time // Zero if the ban never expires
+}
+
+// matches returns true if the ban applies to a user with the given nick and hosts
+func (ban *roomBan) matches(nick string, hosts []string) bool {
+	if ban.nick != "" && strings.EqualFold(ban.nick, nick) {
+		return true
+	}
+	if ban.hostPattern == "" {
+		return false
+	}
+
+	for _, host := range hosts {
+		if matched, _ := path.Match(strings.ToLower(ban.hostPattern), strings.ToLower(host)); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// expired returns true if the ban has run out
+func (ban *roomBan) expired() bool {
+	return !ban.expires.IsZero() && time.Now().After(ban.expires)
+}
+
+// String describes the ban, for example "alice (127.0.0.1) by bob"
+func (ban *roomBan) String() string {
+	return fmt.Sprintf("%s by %s", ban.target(), ban.setBy)
+}
+
+// target describes who the ban applies to, for example "alice (127.0.0.1)"
+func (ban *roomBan) target() string {
+	switch {
+	case ban.nick != "" && ban.hostPattern != "":
+		return fmt.Sprintf("%s (%s)", ban.nick, ban.hostPattern)
+	case ban.nick != "":
+		return ban.nick
+	}
+
+	return ban.hostPattern
+}
+
+// findBan returns the ban keeping a user out of the room, or nil if they aren't banned.
+// Expired bans are removed.
+func (room *room) findBan(nick string, hosts []string) *roomBan {
+	room.removeExpiredBans()
+	for _, ban := range room.bans {
+		if ban.matches(nick, hosts) {
+			return ban
+		}
+	}
+
+	return nil
+}
+
+// removeExpiredBans removes bans that have run out
+func (room *room) removeExpiredBans() {
+	bans := room.bans[:0]
+	for _, ban := range room.bans {
+		if !ban.expired() {
+			bans = append(bans, ban)
+		}
+	}
+	room.bans = bans
+}
+
+// isMuted returns true if a user with the given nick and hosts can't talk in the room.
+// Moderators can always talk, even if they share an address with someone muted.
+// Expired mutes are removed.
+func (room *room) isMuted(nick string, hosts []string) bool {
+	if isRoomMod(room, nick) {
+		return false
+	}
+
+	mutes := room.mutes[:0]
+	muted := false
+	for _, mute := range room.mutes {
+		if mute.expired() {
+			continue
+		}
+		mutes = append(mutes, mute)
+		if mute.matches(nick, hosts) {
+			muted = true
+		}
+	}
+	room.mutes = mutes
+
+	return muted
+}
+
+// Moderator commands
+
+// cmdKick removes a member from the room
+var cmdKick commandHandlerFunc = func(server *server, command *serverCommand) {
+	if len(command.args) < 1 {
+		command.responseChan <- errorReply("Use /kick <nick> [<reason>]\n")
+		return
+	}
+
+	room, ok := getModeratedRoom(server, command)
+	if !ok {
+		return
+	}
+
+	nick, ok := findRoomMember(room, command.args[0])
+	if !ok {
+		command.responseChan <- errorReply("That user isn't in this room.\n")
+		return
+	}
+	if isRoomMod(room, nick) {
+		command.responseChan <- errorReply("You can't kick a moderator; /deop them first.\n")
+		return
+	}
+
+	reason := strings.Join(command.args[1:], " ")
+	server.audit(command, auditEntry{Action: "kick", Target: nick, Room: room.name, Details: reason})
+	kickFromRoom(server, room, nick, fmt.Sprintf("Kicked by %s", command.nick), reason)
+}
+
+// cmdBan bans a user or host pattern from the room.
+// Banning a user who is online also bans their address.
+var cmdBan commandHandlerFunc = func(server *server, command *serverCommand) {
+	if len(command.args) < 1 {
+		command.responseChan <- errorReply("Use /ban <nick|host-pattern> [<duration>] [<reason>]\nDurations look like 30m or 2h; bans without one last until they are removed with /unban.\n")
+		return
+	}
+
+	room, ok := getModeratedRoom(server, command)
+	if !ok {
+		return
+	}
+
+	ban, ok := parseBan(server, command)
+	if !ok {
+		return
+	}
+	if ban.nick != "" && isRoomMod(room, ban.nick) {
+		command.responseChan <- errorReply("You can't ban a moderator; /deop them first.\n")
+		return
+	}
+
+	room.bans = append(room.bans, ban)
+	server.roomChanged(room)
+	server.audit(command, auditEntry{Action: "ban", Target: ban.target(), Room: room.name, Details: strings.TrimSpace(describeExpiry(ban.expires) + " " + ban.reason)})
+	command.responseChan <- reply(fmt.Sprintf("Banned %s%s\n", ban, describeExpiry(ban.expires)))
+
+	// Kick anyone in the room who the ban applies to
+	members := make([]string, 0, len(room.users))
+	for nick := range room.users {
+		members = append(members, nick)
+	}
+	for _, nick := range members {
+		if ban.matches(nick, clientHosts(server.clients[strings.ToLower(nick)])) {
+			kickFromRoom(server, room, nick, fmt.Sprintf("Banned by %s", command.nick), ban.reason)
+		}
+	}
+}
+
+// parseBan reads a ban from a command's args, which look like <nick|host-pattern> [<duration>] [<reason>].
+// Banning a user who is online also bans their address.
+// If the args are invalid, the user is told why, and ok is false.
+func parseBan(server *server, command *serverCommand) (ban *roomBan, ok bool) {
+	ban = &roomBan{setBy: command.nick}
+	target := command.args[0]
+	if client, online := server.clients[strings.ToLower(target)]; online {
+		if nick, ok := client.GetVar("nick").(string); ok {
+			target = nick
+		}
+		ban.nick = target
+		ban.hostPattern = clientAddr(client)
+	} else if strings.ContainsAny(target, ".:*?[") {
+		if _, err := path.Match(target, ""); err != nil {
+			command.responseChan <- errorReply("Invalid host pattern.\n")
+			return nil, false
+		}
+		ban.hostPattern = target
+	} else {
+		ban.nick = target
+	}
+
+	reasonArgs := command.args[1:]
+	if len(reasonArgs) > 0 {
+		if duration, err := time.ParseDuration(reasonArgs[0]); err == nil && duration > 0 {
+			ban.expires = time.Now().Add(duration)
+			reasonArgs = reasonArgs[1:]
+		}
+	}
+	ban.reason = strings.Join(reasonArgs, " ")
+
+	return ban, true
+}
+
+// cmdUnban removes bans on a nick or host pattern
+var cmdUnban commandHandlerFunc = func(server *server, command *serverCommand) {
+	if len(command.args) < 1 {
+		command.responseChan <- errorReply("Use /unban <nick|host-pattern>\n/bans lists the room's bans.\n")
+		return
+	}
+
+	room, ok := getModeratedRoom(server, command)
+	if !ok {
+		return
+	}
+
+	target := command.args[0]
+	bans := room.bans[:0]
+	removed := 0
+	for _, ban := range room.bans {
+		if strings.EqualFold(ban.nick, target) || (ban.hostPattern != "" && strings.EqualFold(ban.hostPattern, target)) {
+			removed++
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	room.bans = bans
+
+	if removed == 0 {
+		command.responseChan <- errorReply("No bans match that.\n")
+		return
+	}
+
+	server.roomChanged(room)
+	server.audit(command, auditEntry{Action: "unban", Target: target, Room: room.name})
+	command.responseChan <- reply(fmt.Sprintf("Removed %d %s.\n", removed, plural(removed, "ban", "bans")))
+}
+
+// cmdBans lists the room's bans
+var cmdBans commandHandlerFunc = func(server *server, command *serverCommand) {
+	room, ok := getModeratedRoom(server, command)
+	if !ok {
+		return
+	}
+
+	room.removeExpiredBans()
+	bans := make([]banInfo, 0, len(room.bans))
+	if len(room.bans) == 0 {
+		command.responseChan <- &event{Type: eventBans, Time: time.Now(), Room: room.name, Text: "Nobody is banned from this room.\n", Data: bans}
+		return
+	}
+
+	response := make([]string, 0, len(room.bans)+1)
+	response = append(response, "Bans:")
+	for _, ban := range room.bans {
+		line := fmt.Sprintf("%s%s", ban, describeExpiry(ban.expires))
+		if ban.reason != "" {
+			line += fmt.Sprintf(": %s", ban.reason)
+		}
+		response = append(response, line)
+		bans = append(bans, banInfo{Nick: ban.nick, HostPattern: ban.hostPattern, SetBy: ban.setBy, Reason: ban.reason, Expires: ban.expires})
+	}
+
+	command.responseChan <- &event{Type: eventBans, Time: time.Now(), Room: room.name, Text: strings.Join(response, "\n") + "\n", Data: bans}
+}
+
+// cmdMute stops a member from talking in the room
+var cmdMute commandHandlerFunc = func(server *server, command *serverCommand) {
+	if len(command.args) < 1 {
+		command.responseChan <- errorReply("Use /mute <nick> [<duration>]\nDurations look like 30m or 2h; mutes without one last until they are removed with /unmute.\n")
+		return
+	}
+
+	room, ok := getModeratedRoom(server, command)
+	if !ok {
+		return
+	}
+
+	nick, ok := findRoomMember(room, command.args[0])
+	if !ok {
+		command.responseChan <- errorReply("That user isn't in this room.\n")
+		return
+	}
+	if isRoomMod(room, nick) {
+		command.responseChan <- errorReply("You can't mute a moderator; /deop them first.\n")
+		return
+	}
+
+	var expires time.Time
+	if len(command.args) >= 2 {
+		duration, err := time.ParseDuration(command.args[1])
+		if err != nil || duration <= 0 {
+			command.responseChan <- errorReply("Invalid duration; try something like 30m or 2h.\n")
+			return
+		}
+		expires = time.Now().Add(duration)
+	}
+
+	// Muting the address too keeps the user muted if they come back with a different nick
+	room.mutes = append(room.mutes, &roomBan{nick: nick, hostPattern: clientAddr(server.clients[strings.ToLower(nick)]), setBy: command.nick, expires: expires})
+	server.audit(command, auditEntry{Action: "mute", Target: nick, Room: room.name, Details: strings.TrimSpace(describeExpiry(expires))})
+	sayToRoom(server, room.name, fmt.Sprintf("%s was muted by %s%s", nick, command.nick, describeExpiry(expires)))
+}
+
+// cmdUnmute lets a muted member talk again
+var cmdUnmute commandHandlerFunc = func(server *server, command *serverCommand) {
+	if len(command.args) < 1 {
+		command.responseChan <- errorReply("Use /unmute <nick>\n")
+		return
+	}
+
+	room, ok := getModeratedRoom(server, command)
+	if !ok {
+		return
+	}
+
+	nick := command.args[0]
+	if member, ok := findRoomMember(room, nick); ok {
+		nick = member
+	}
+	hosts := clientHosts(server.clients[strings.ToLower(nick)])
+	if !room.isMuted(nick, hosts) {
+		command.responseChan <- errorReply(fmt.Sprintf("%s isn't muted.\n", nick))
+		return
+	}
+
+	mutes := room.mutes[:0]
+	for _, mute := range room.mutes {
+		if !mute.matches(nick, hosts) {
+			mutes = append(mutes, mute)
+		}
+	}
+	room.mutes = mutes
+	server.audit(command, auditEntry{Action: "unmute", Target: nick, Room: room.name})
+	sayToRoom(server, room.name, fmt.Sprintf("%s was unmuted by %s", nick, command.nick))
+}
+
+// Helper functions
+
+// getModeratedRoom gets the active room of the user running a moderator command.
+// If they aren't in a room, or aren't a moderator of it, they are told so, and ok is false.
+func getModeratedRoom(server *server, command *serverCommand) (*room, bool) {
+	room, ok := getActiveRoom(server, command.nick)
+	if !ok {
+		command.responseChan <- errorReply("You must be in a room to do that.\n")
+		return nil, false
+	}
+	if !isRoomMod(room, command.nick) {
+		command.responseChan <- errorReply("Only moderators can do that.\n")
+		return nil, false
+	}
+
+	return room, true
+}
+
+// kickFromRoom removes a member from a room, and tells them why
+func kickFromRoom(server *server, room *room, nick, action, reason string) {
+	message := action
+	if reason != "" {
+		message = fmt.Sprintf("%s: %s", action, reason)
+	}
+
+	leaveRoom(server, nick, room.name, message)
+	if responseChan := server.userResponseChan[nick]; responseChan != nil {
+		responseChan <- &event{
+			Type: eventLeave,
+			Time: time.Now(),
+			Room: room.name,
+			From: nick,
+			Body: message,
+			Text: fmt.Sprintf("You were removed from %s. %s\n", room.name, message),
+		}
+	}
+}
+
+// describeExpiry describes when something expires, for example " for 29m59s"
+func describeExpiry(expires time.Time) string {
+	if expires.IsZero() {
+		return ""
+	}
+
+	return fmt.Sprintf(" for %s", time.Until(expires).Round(time.Second))
+}
+
+// plural returns singular if n is 1, and plural otherwise
+func plural(n int, singular, plural string) string {
+	if n == 1 {
+		return singular
+	}
+
+	return plural
+}
+
+// clientAddr gets the IP address a client connected from
+func clientAddr(client *Client) string {
+	hosts := clientHosts(client)
+	if len(hosts) == 0 {
+		return ""
+	}
+
+	return hosts[0]
+}
+
+// clientHosts gets the IP address a client connected from, followed by its host name, if it has a confirmed one.
+// The host name is looked up in the background, so it might not be there yet;
+// bans are checked again once it is found, by cmdHostfound.
+func clientHosts(client *Client) []string {
+	if client == nil {
+		return nil
+	}
+	remoteAddr, ok := client.GetVar("remote_addr").(string)
+	if !ok || remoteAddr == "" {
+		return nil
+	}
+
+	hosts := []string{remoteAddr}
+	if host, ok := client.GetVar("remote_host").(string); ok && host != "" {
+		hosts = append(hosts, host)
+	}
+
+	return hosts
+}
@@ -0,0 +1,220 @@
+package chatsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// persistedRoom is how a persistent room is saved to disk.
+// Only what should survive a restart is kept; members and mutes aren't.
+type persistedRoom struct {
+	Name         string
+	Creater      string
+	Topic        persistedTopic
+	TopicHistory []persistedTopic `json:",omitempty"`
+	OpenTopic    bool
+	Logging      bool
+	ModAccounts  []string       `json:",omitempty"`
+	ModPass      string         `json:",omitempty"`
+	RoomPass     string         `json:",omitempty"`
+	Bans         []persistedBan `json:",omitempty"`
+}
+
+type persistedTopic struct {
+	Text  string
+	SetBy string
+	SetAt time.Time
+}
+
+type persistedBan struct {
+	Nick        string `json:",omitempty"`
+	HostPattern string `json:",omitempty"`
+	SetBy       string
+	Reason      string    `json:",omitempty"`
+	Expires     time.Time `json:",omitempty"`
+}
+
+// LoadRooms restores the persistent rooms saved in config.RoomsFile,
+// and creates any rooms listed in config.PersistentRooms that don't exist yet.
+// It must be called before the server is started.
+func (server *server) LoadRooms() error {
+	if server.config.RoomsFile != "" {
+		data, err := ioutil.ReadFile(server.config.RoomsFile)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "Cannot read rooms")
+		}
+		if err == nil {
+			var persistedRooms []persistedRoom
+			if err := json.Unmarshal(data, &persistedRooms); err != nil {
+				return errors.Wrapf(err, "Cannot parse rooms in %s", server.config.RoomsFile)
+			}
+			for _, persisted := range persistedRooms {
+				if !isValidRoomName(persisted.Name) {
+					return fmt.Errorf("Invalid room name in %s: %q; room names can contain only letters and numbers", server.config.RoomsFile, persisted.Name)
+				}
+				room := persisted.restore(server.config.HistorySize)
+				server.rooms[strings.ToLower(room.name)] = room
+			}
+			log.Printf("Loaded %d rooms from %s\n", len(persistedRooms), server.config.RoomsFile)
+		}
+	}
+
+	for _, name := range server.config.PersistentRooms {
+		if !isValidRoomName(name) {
+			return fmt.Errorf("Invalid permanent room name: %q; room names can contain only letters and numbers", name)
+		}
+		room, exists := server.rooms[strings.ToLower(name)]
+		if !exists {
+			room = newRoom(name, server.config.ServerName, server.config.HistorySize)
+			room.logging = server.config.LogNewRooms && server.roomLogger != nil
+			server.rooms[strings.ToLower(name)] = room
+		}
+		room.persistent = true
+	}
+
+	return nil
+}
+
+// roomChanged notes that something saved with a room changed, so persistent rooms are saved after the command.
+// Must only be called from the goroutine running acceptCommands.
+func (server *server) roomChanged(room *room) {
+	if room.persistent {
+		server.roomsChanged = true
+	}
+}
+
+// saveRoomsIfChanged writes persistent rooms to config.RoomsFile, if roomChanged was called since they were last saved.
+// If they can't be saved, it tries again after the next command.
+// Must only be called from the goroutine running acceptCommands.
+func (server *server) saveRoomsIfChanged() {
+	if server.config.RoomsFile == "" || !server.roomsChanged {
+		return
+	}
+
+	data, err := server.encodePersistentRooms()
+	if err != nil {
+		log.Printf("Error saving rooms: %s\n", err)
+		return
+	}
+	if err := writeFileAtomically(server.config.RoomsFile, data); err != nil {
+		log.Printf("Error saving rooms: %s\n", err)
+		return
+	}
+	server.roomsChanged = false
+}
+
+// encodePersistentRooms encodes all persistent rooms, sorted by name so unchanged rooms always encode the same way.
+func (server *server) encodePersistentRooms() ([]byte, error) {
+	persistedRooms := make([]persistedRoom, 0)
+	for _, room := range server.rooms {
+		if room.persistent {
+			room.removeExpiredBans()
+			persistedRooms = append(persistedRooms, room.persist())
+		}
+	}
+	sort.Slice(persistedRooms, func(i, j int) bool {
+		return strings.ToLower(persistedRooms[i].Name) < strings.ToLower(persistedRooms[j].Name)
+	})
+
+	data, err := json.MarshalIndent(persistedRooms, "", "\t")
+	return data, errors.Wrap(err, "Cannot encode rooms")
+}
+
+// persist gets the parts of a room that are saved to disk
+func (room *room) persist() persistedRoom {
+	persisted := persistedRoom{
+		Name:      room.name,
+		Creater:   room.creater,
+		Topic:     persistedTopic{Text: room.topic.text, SetBy: room.topic.setBy, SetAt: room.topic.setAt},
+		OpenTopic: room.openTopic,
+		Logging:   room.logging,
+		ModPass:   room.modPass,
+		RoomPass:  room.roomPass,
+	}
+	for _, topic := range room.topicHistory {
+		persisted.TopicHistory = append(persisted.TopicHistory, persistedTopic{Text: topic.text, SetBy: topic.setBy, SetAt: topic.setAt})
+	}
+	for account := range room.modAccounts {
+		persisted.ModAccounts = append(persisted.ModAccounts, account)
+	}
+	sort.Strings(persisted.ModAccounts)
+	for _, ban := range room.bans {
+		persisted.Bans = append(persisted.Bans, ban.persist())
+	}
+
+	return persisted
+}
+
+// restore creates a persistent room from what was saved to disk
+func (persisted persistedRoom) restore(historySize int) *room {
+	room := newRoom(persisted.Name, persisted.Creater, historySize)
+	room.persistent = true
+	room.topic = roomTopic{text: persisted.Topic.Text, setBy: persisted.Topic.SetBy, setAt: persisted.Topic.SetAt}
+	for _, topic := range persisted.TopicHistory {
+		room.topicHistory = append(room.topicHistory, roomTopic{text: topic.Text, setBy: topic.SetBy, setAt: topic.SetAt})
+	}
+	room.openTopic = persisted.OpenTopic
+	room.logging = persisted.Logging
+	room.modPass = persisted.ModPass
+	room.roomPass = persisted.RoomPass
+	for _, account := range persisted.ModAccounts {
+		room.modAccounts[strings.ToLower(account)] = struct{}{}
+	}
+	for _, ban := range persisted.Bans {
+		room.bans = append(room.bans, ban.restore())
+	}
+
+	return room
+}
+
+// persist gets a ban as it is saved to disk
+func (ban *roomBan) persist() persistedBan {
+	return persistedBan{
+		Nick:        ban.nick,
+		HostPattern: ban.hostPattern,
+		SetBy:       ban.setBy,
+		Reason:      ban.reason,
+		Expires:     ban.expires,
+	}
+}
+
+// restore gets a ban back from what was saved to disk
+func (persisted persistedBan) restore() *roomBan {
+	return &roomBan{
+		nick:        persisted.Nick,
+		hostPattern: persisted.HostPattern,
+		setBy:       persisted.SetBy,
+		reason:      persisted.Reason,
+		expires:     persisted.Expires,
+	}
+}
+
+// cmdPersist makes the room permanent, so it is kept when empty, and survives restarts
+var cmdPersist commandHandlerFunc = func(server *server, command *serverCommand) {
+	if len(command.args) < 1 || (command.args[0] != "on" && command.args[0] != "off") {
+		command.responseChan <- errorReply("Use /persist on|off\nPermanent rooms stay around when everyone leaves, along with their topic, moderators, passwords, bans and logging.\n")
+		return
+	}
+
+	room, ok := getModeratedRoom(server, command)
+	if !ok {
+		return
+	}
+
+	room.persistent = command.args[0] == "on"
+	server.roomsChanged = true
+	if room.persistent {
+		sayToRoom(server, room.name, fmt.Sprintf("%s made this room permanent", command.nick))
+		command.responseChan <- reply("Only moderators who were logged into an account when they got moderator status will keep it when they come back.\n")
+	} else {
+		sayToRoom(server, room.name, fmt.Sprintf("%s made this room temporary; it will be closed when everyone leaves", command.nick))
+	}
+}
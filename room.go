@@ -1,14 +1,56 @@
 package chatsrv
 
+import (
+	"fmt"
+	"time"
+)
+
 // Room represents a chat room on the server.
 // The creater may or may not be a moderator (is when NewRoom is called).
-// The room is closed when there are no more members.
+// The room is closed when there are no more members, unless it is persistent.
 type room struct {
 	creater  string
 	mods     map[string]struct{}
 	users    map[string]struct{} // mods not included
 	name     string
-	topic    string
+	topic    roomTopic
 	modPass  string // A normal user can become a moderator with this password
 	roomPass string // Makes a room private
+	bans     []*roomBan
+	mutes    []*roomBan // Who can't talk; like bans, they match by nick or address
+
+	topicHistory []roomTopic // Previous topics, oldest first
+	openTopic    bool        // If true, anyone in the room can change the topic, not just moderators
+
+	// Lowercase nicks of accounts that are moderators of this room.
+	// Users logged into one of these accounts become moderators when they join.
+	modAccounts map[string]struct{}
+	persistent  bool // Persistent rooms are kept when empty, and saved so they survive restarts
+
+	history *roomHistory // Recent lines said in the room
+	logging bool         // Everything said in the room is written to the server's room logs
+}
+
+// newRoom creates an empty room, which remembers historySize lines said in it
+func newRoom(name, creater string, historySize int) *room {
+	return &room{
+		creater:     creater,
+		mods:        make(map[string]struct{}),
+		users:       make(map[string]struct{}),
+		modAccounts: make(map[string]struct{}),
+		name:        name,
+		history:     newRoomHistory(historySize),
+	}
+}
+
+// roomTopic is a room's topic, and who set it
+type roomTopic struct {
+	text  string
+	setBy string
+	setAt time.Time
+}
+
+// attribution describes who set the topic, and when
+func (topic roomTopic) attribution() string {
+	return fmt.Sprintf("Set by %s (%s)", topic.setBy, describeTimeSince(topic.setAt))
 }
@@ -0,0 +1,162 @@
+package chatsrv
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// screenReader returns true if the user turned on screen reader mode
+func screenReader(client *Client) bool {
+	on, _ := client.GetVar("screen_reader").(bool)
+	return on
+}
+
+// hideEvent returns true if the user asked not to see an event, such as other people joining and leaving rooms
+func hideEvent(client *Client, ev *event) bool {
+	if quiet, _ := client.GetVar("quiet_joins").(bool); !quiet {
+		return false
+	}
+	if ev.Type != eventJoin && ev.Type != eventLeave {
+		return false
+	}
+
+	nick, _ := client.GetVar("nick").(string)
+	return ev.From != nick
+}
+
+// A timestamp at the start of a line, as in history, such as "[14:05]" or "[Jan 2 14:05]"
+var bracketedTimestamp = regexp.MustCompile(`^\[((?:[A-Z][a-z]{2} [0-9]{1,2} )?[0-9]{1,2}:[0-9]{2}(?::[0-9]{2})?)\] `)
+
+// Lines made only of decoration, such as a row of dashes
+var decorationLine = regexp.MustCompile(`^[-=_*~#+.]{3,}$`)
+
+// screenReaderText gets the text of an event, written to be read aloud.
+// Tables become sentences, multiline messages say how many lines they have instead of indenting them,
+// and decoration is left out.
+func screenReaderText(client *Client, ev *event) string {
+	nick, _ := client.GetVar("nick").(string)
+	switch ev.Type {
+	case eventUsers:
+		if users, ok := ev.Data.([]userInfo); ok {
+			return describeUsers(users)
+		}
+	case eventRooms:
+		if rooms, ok := ev.Data.([]*roomInfo); ok {
+			return describeRooms(rooms)
+		}
+	case eventMessage:
+		if lines := strings.Count(ev.Body, "\n") + 1; lines > 1 {
+			return fmt.Sprintf("%s said %d lines:\n%s\n", ev.From, lines, ev.Body)
+		}
+	case eventAction:
+		if lines := strings.Count(ev.Body, "\n") + 1; lines > 1 {
+			return fmt.Sprintf("%s, %d lines:\n%s %s\n", ev.From, lines, ev.From, ev.Body)
+		}
+	case eventPrivate:
+		header := fmt.Sprintf("Private message from %s", ev.From)
+		if ev.From == nick {
+			header = fmt.Sprintf("Private message to %s", ev.To)
+		}
+		if lines := strings.Count(ev.Body, "\n") + 1; lines > 1 {
+			return fmt.Sprintf("%s, %d lines:\n%s\n", header, lines, ev.Body)
+		}
+		return fmt.Sprintf("%s: %s\n", header, ev.Body)
+	}
+
+	return cleanForSpeech(ev.Text)
+}
+
+// describeUsers lists users as sentences
+func describeUsers(users []userInfo) string {
+	response := make([]string, 0, len(users)+1)
+	response = append(response, fmt.Sprintf("%d %s online:", len(users), plural(len(users), "user is", "users are")))
+	for _, user := range users {
+		where := "not in a room"
+		if user.Room != "" {
+			where = "in " + user.Room
+			if user.Mod {
+				where += " as a moderator"
+			}
+		}
+		sentence := fmt.Sprintf("%s, %s, %s", user.Nick, where, describeLastActive(user.LastSeen, time.Now()))
+		if user.Away != "" {
+			sentence += fmt.Sprintf(", away: %s", user.Away)
+		}
+		response = append(response, sentence+".")
+	}
+
+	return strings.Join(response, "\n") + "\n"
+}
+
+// describeRooms lists rooms as sentences
+func describeRooms(rooms []*roomInfo) string {
+	response := make([]string, 0, len(rooms)+1)
+	response = append(response, fmt.Sprintf("%d %s:", len(rooms), plural(len(rooms), "room", "rooms")))
+	for _, room := range rooms {
+		details := []string{"public"}
+		if room.Private {
+			details[0] = "private"
+		}
+		if room.Permanent {
+			details = append(details, "permanent")
+		}
+		if room.Logged {
+			details = append(details, "logged")
+		}
+		details = append(details, fmt.Sprintf("%d %s", room.Size, plural(room.Size, "member", "members")))
+
+		sentence := fmt.Sprintf("%s, %s.", room.Name, strings.Join(details, ", "))
+		if room.Topic != "" {
+			sentence += fmt.Sprintf(" Topic: %s", room.Topic)
+		}
+		response = append(response, sentence)
+	}
+
+	return strings.Join(response, "\n") + "\n"
+}
+
+// describeLastActive says when a user was last active, in words that read well aloud,
+// such as "idle for 12 minutes" or "idle since 14:05"
+func describeLastActive(lastSeen, now time.Time) string {
+	if lastSeen.IsZero() {
+		return "never active"
+	}
+
+	idle := now.Sub(lastSeen)
+	switch {
+	case idle < time.Minute:
+		return "active now"
+	case idle < time.Hour:
+		minutes := int(idle / time.Minute)
+		return fmt.Sprintf("idle for %d %s", minutes, plural(minutes, "minute", "minutes"))
+	}
+
+	lastSeen = lastSeen.In(now.Location())
+	if y, m, d := lastSeen.Date(); now.Year() == y && now.Month() == m && now.Day() == d {
+		return fmt.Sprintf("idle since %s", lastSeen.Format("15:04"))
+	}
+	if lastSeen.Year() == now.Year() {
+		return fmt.Sprintf("idle since %s", lastSeen.Format("January 2 at 15:04"))
+	}
+
+	return fmt.Sprintf("idle since %s", lastSeen.Format("January 2, 2006 at 15:04"))
+}
+
+// cleanForSpeech takes decoration out of text: indentation, tabs, brackets around timestamps, and lines of dashes.
+func cleanForSpeech(text string) string {
+	lines := strings.Split(text, "\n")
+	cleaned := make([]string, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimLeft(line, " ")
+		line = strings.Replace(line, "\t", ", ", -1)
+		line = bracketedTimestamp.ReplaceAllString(line, "$1, ")
+		if decorationLine.MatchString(line) {
+			continue
+		}
+		cleaned = append(cleaned, line)
+	}
+
+	return strings.Join(cleaned, "\n")
+}
@@ -0,0 +1,65 @@
+package chatsrv
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDescribeLastActive(t *testing.T) {
+	now := time.Date(2017, 4, 1, 15, 30, 0, 0, time.UTC)
+	tests := []struct {
+		lastSeen time.Time
+		want     string
+	}{
+		{time.Time{}, "never active"},
+		{now, "active now"},
+		{now.Add(-59 * time.Second), "active now"},
+		{now.Add(-time.Minute), "idle for 1 minute"},
+		{now.Add(-12*time.Minute - 30*time.Second), "idle for 12 minutes"},
+		{now.Add(-59 * time.Minute), "idle for 59 minutes"},
+		{time.Date(2017, 4, 1, 14, 5, 0, 0, time.UTC), "idle since 14:05"},
+		{time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC), "idle since 00:00"},
+		{time.Date(2017, 3, 31, 23, 45, 0, 0, time.UTC), "idle since March 31 at 23:45"},
+		{time.Date(2016, 12, 25, 9, 0, 0, 0, time.UTC), "idle since December 25, 2016 at 09:00"},
+		{time.Date(2017, 4, 1, 16, 5, 0, 0, time.FixedZone("UTC+2", 2*60*60)), "idle since 14:05"}, // Said in the server's time zone
+	}
+
+	for _, test := range tests {
+		if got := describeLastActive(test.lastSeen, now); got != test.want {
+			t.Errorf("describeLastActive(%s) = %q, want %q", test.lastSeen, got, test.want)
+		}
+	}
+}
+
+func TestCleanForSpeech(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"[14:05] alice: hi", "14:05, alice: hi"},
+		{"[Jan 2 14:05] alice: hi", "Jan 2 14:05, alice: hi"},
+		{"[Dec 25 09:00] alice: hi", "Dec 25 09:00, alice: hi"},
+		{"[14:05:09] alice: hi", "14:05:09, alice: hi"},
+		{"alice: [14:05] isn't at the start", "alice: [14:05] isn't at the start"},
+		{"[not a time] alice: hi", "[not a time] alice: hi"},
+		{"Users:\n-----\n  alice\tlobby", "Users:\nalice, lobby"},
+		{"History:\n[14:05] alice: hi\n[Jan 2 09:00] bob: bye", "History:\n14:05, alice: hi\nJan 2 09:00, bob: bye"},
+	}
+
+	for _, test := range tests {
+		if got := cleanForSpeech(test.text); got != test.want {
+			t.Errorf("cleanForSpeech(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestHistoryLineSpoken(t *testing.T) {
+	// Lines from history, today's and older ones, must both lose their brackets
+	for _, when := range []time.Time{time.Now(), time.Now().AddDate(0, 0, -3)} {
+		line := historyLine{time: when, text: "alice: hi"}
+		if got := cleanForSpeech(line.String()); strings.HasPrefix(got, "[") {
+			t.Errorf("history line %q was read as %q", line.String(), got)
+		}
+	}
+}
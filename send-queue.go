@@ -0,0 +1,142 @@
+package chatsrv
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// SendQueuePolicy determines what happens when a client's send queue is full.
+type SendQueuePolicy byte
+
+const (
+	SendQueueDropOldest = SendQueuePolicy(iota) // Discard the oldest queued data to make room
+	SendQueueDropNewest                         // Discard the data that didn't fit
+	SendQueueDisconnect                         // Disconnect the client
+)
+
+// ParseSendQueuePolicy converts a policy name, as found in the configuration file, to a SendQueuePolicy.
+func ParseSendQueuePolicy(name string) (SendQueuePolicy, error) {
+	switch strings.ToLower(name) {
+	case "dropoldest", "":
+		return SendQueueDropOldest, nil
+	case "dropnewest":
+		return SendQueueDropNewest, nil
+	case "disconnect":
+		return SendQueueDisconnect, nil
+	}
+
+	return SendQueueDropOldest, fmt.Errorf("Invalid send queue policy: %s", name)
+}
+
+// sendQueue holds events waiting to be sent to a client.
+// Pushing never blocks, so the server can't be held up by a client that isn't reading.
+// When the queue goes over its high-water mark, its policy decides what to do.
+// A limit of 0 means unlimited.
+type sendQueue struct {
+	lock        sync.Mutex // protects everything below
+	items       []*event
+	size        int // Total bytes of text in items
+	maxMessages int
+	maxBytes    int
+	policy      SendQueuePolicy
+	dropped     int  // Number of messages discarded because the queue was full
+	overflowed  bool // Set when the policy is SendQueueDisconnect, and the queue filled up
+	closed      bool
+	ready       chan struct{} // Receives a value when there is something to pop
+}
+
+func newSendQueue(maxMessages, maxBytes int, policy SendQueuePolicy) *sendQueue {
+	return &sendQueue{
+		maxMessages: maxMessages,
+		maxBytes:    maxBytes,
+		policy:      policy,
+		ready:       make(chan struct{}, 1),
+	}
+}
+
+// push adds an event to the end of the queue.
+// Returns true if this push made the queue overflow.
+// Events pushed after the queue is closed or has overflowed are discarded.
+func (queue *sendQueue) push(ev *event) bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if queue.closed || queue.overflowed {
+		return false
+	}
+
+	for queue.full(len(ev.Text)) {
+		switch queue.policy {
+		case SendQueueDropNewest:
+			queue.dropped++
+			return false
+		case SendQueueDisconnect:
+			queue.overflowed = true
+			queue.signal()
+			return true
+		}
+
+		if len(queue.items) == 0 {
+			// Too big to ever fit
+			queue.dropped++
+			return false
+		}
+		queue.size -= len(queue.items[0].Text)
+		queue.items[0] = nil
+		queue.items = queue.items[1:]
+		queue.dropped++
+	}
+
+	queue.items = append(queue.items, ev)
+	queue.size += len(ev.Text)
+	queue.signal()
+	return false
+}
+
+// full returns true if adding n more bytes would go over the high-water mark.
+// queue.lock must be held.
+func (queue *sendQueue) full(n int) bool {
+	if queue.maxMessages > 0 && len(queue.items)+1 > queue.maxMessages {
+		return true
+	}
+	if queue.maxBytes > 0 && queue.size+n > queue.maxBytes {
+		return true
+	}
+
+	return false
+}
+
+// signal lets the reader know there is something waiting.
+// queue.lock must be held.
+func (queue *sendQueue) signal() {
+	select {
+	case queue.ready <- struct{}{}:
+	default: // Already signaled
+	}
+}
+
+// pop removes and returns everything in the queue.
+// It also reports whether the queue overflowed or was closed.
+func (queue *sendQueue) pop() (items []*event, overflowed, closed bool) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	items = queue.items
+	queue.items = nil
+	queue.size = 0
+	return items, queue.overflowed, queue.closed
+}
+
+// close marks the queue as closed; anything pushed afterwards is discarded.
+func (queue *sendQueue) close() {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.closed = true
+	queue.signal()
+}
+
+// Dropped returns the number of messages that were discarded because the queue was full.
+func (queue *sendQueue) Dropped() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return queue.dropped
+}
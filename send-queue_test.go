@@ -0,0 +1,151 @@
+package chatsrv
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSendQueuePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    SendQueuePolicy
+		wantErr bool
+	}{
+		{"", SendQueueDropOldest, false},
+		{"dropOldest", SendQueueDropOldest, false},
+		{"DROPNEWEST", SendQueueDropNewest, false},
+		{"disconnect", SendQueueDisconnect, false},
+		{"drop", SendQueueDropOldest, true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseSendQueuePolicy(test.name)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseSendQueuePolicy(%q) error = %v, want an error: %v", test.name, err, test.wantErr)
+		}
+		if got != test.want {
+			t.Errorf("ParseSendQueuePolicy(%q) = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+// queueTexts gets the text of the events in a queue, joined with spaces
+func queueTexts(items []*event) string {
+	texts := make([]string, 0, len(items))
+	for _, ev := range items {
+		texts = append(texts, ev.Text)
+	}
+
+	return strings.Join(texts, " ")
+}
+
+func TestSendQueuePush(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxMessages    int
+		maxBytes       int
+		policy         SendQueuePolicy
+		push           []string
+		want           string // Texts left in the queue
+		wantDropped    int
+		wantOverflowed bool
+	}{
+		{"unlimited", 0, 0, SendQueueDropOldest, []string{"a", "b", "c", "d"}, "a b c d", 0, false},
+		{"under the message limit", 3, 0, SendQueueDropOldest, []string{"a", "b", "c"}, "a b c", 0, false},
+
+		{"drop oldest at the message limit", 3, 0, SendQueueDropOldest, []string{"a", "b", "c", "d", "e"}, "c d e", 2, false},
+		{"drop newest at the message limit", 3, 0, SendQueueDropNewest, []string{"a", "b", "c", "d", "e"}, "a b c", 2, false},
+		{"disconnect at the message limit", 3, 0, SendQueueDisconnect, []string{"a", "b", "c", "d", "e"}, "a b c", 0, true},
+
+		{"drop oldest at the byte limit", 0, 6, SendQueueDropOldest, []string{"aa", "bb", "cc", "dddd"}, "cc dddd", 2, false},
+		{"drop newest at the byte limit", 0, 6, SendQueueDropNewest, []string{"aa", "bb", "cc", "dddd", "e"}, "aa bb cc", 2, false},
+		{"disconnect at the byte limit", 0, 6, SendQueueDisconnect, []string{"aa", "bb", "cc", "d"}, "aa bb cc", 0, true},
+
+		{"drop oldest with something too big to ever fit", 0, 4, SendQueueDropOldest, []string{"aa", "bbbbbb", "cc"}, "cc", 2, false},
+		{"both limits", 3, 6, SendQueueDropOldest, []string{"a", "b", "c", "dddddd"}, "dddddd", 3, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue := newSendQueue(test.maxMessages, test.maxBytes, test.policy)
+			overflows := 0
+			for _, text := range test.push {
+				if queue.push(&event{Text: text}) {
+					overflows++
+				}
+			}
+
+			items, overflowed, closed := queue.pop()
+			if got := queueTexts(items); got != test.want {
+				t.Errorf("queue has %q, want %q", got, test.want)
+			}
+			if queue.Dropped() != test.wantDropped {
+				t.Errorf("dropped %d, want %d", queue.Dropped(), test.wantDropped)
+			}
+			if overflowed != test.wantOverflowed {
+				t.Errorf("overflowed = %v, want %v", overflowed, test.wantOverflowed)
+			}
+			if test.wantOverflowed && overflows != 1 {
+				t.Errorf("push reported %d overflows, want 1", overflows)
+			}
+			if closed {
+				t.Error("queue was closed")
+			}
+		})
+	}
+}
+
+func TestSendQueuePop(t *testing.T) {
+	queue := newSendQueue(0, 4, SendQueueDropNewest)
+	queue.push(&event{Text: "aa"})
+	queue.push(&event{Text: "bb"})
+	select {
+	case <-queue.ready:
+	default:
+		t.Fatal("queue didn't signal that it had something to pop")
+	}
+
+	if items, _, _ := queue.pop(); queueTexts(items) != "aa bb" {
+		t.Fatalf("popped %q, want \"aa bb\"", queueTexts(items))
+	}
+	if items, _, _ := queue.pop(); len(items) != 0 {
+		t.Fatalf("popped %q from an empty queue", queueTexts(items))
+	}
+
+	// Popping makes room again
+	queue.push(&event{Text: "cccc"})
+	if items, _, _ := queue.pop(); queueTexts(items) != "cccc" {
+		t.Errorf("popped %q after making room, want \"cccc\"", queueTexts(items))
+	}
+}
+
+func TestSendQueueClose(t *testing.T) {
+	queue := newSendQueue(0, 0, SendQueueDropOldest)
+	queue.push(&event{Text: "a"})
+	queue.close()
+	queue.push(&event{Text: "b"})
+
+	items, _, closed := queue.pop()
+	if !closed {
+		t.Error("queue isn't closed")
+	}
+	if queueTexts(items) != "a" {
+		t.Errorf("popped %q, want only what was pushed before closing", queueTexts(items))
+	}
+}
+
+func TestSendQueueDisconnectDiscardsAfterOverflow(t *testing.T) {
+	queue := newSendQueue(1, 0, SendQueueDisconnect)
+	queue.push(&event{Text: "a"})
+	if !queue.push(&event{Text: "b"}) {
+		t.Fatal("push over the limit didn't overflow")
+	}
+	if queue.push(&event{Text: "c"}) {
+		t.Error("push after overflowing reported another overflow")
+	}
+	queue.pop()
+	queue.push(&event{Text: "d"})
+	if items, overflowed, _ := queue.pop(); len(items) != 0 || !overflowed {
+		t.Errorf("after overflowing, popped %q, overflowed = %v; want nothing, and overflowed", queueTexts(items), overflowed)
+	}
+}
@@ -32,12 +32,19 @@ func (f commandHandlerFunc) Handle(server *server, command *serverCommand) {
 type serverCommand struct {
 	nick          string        // Command's originator
 	client        *Client       // Lookup by nick is easier, but impossible if no nick->client mapping exists yet.
-	responseChan  chan<- []byte // Replies go here
+	responseChan  chan<- *event // Replies go here
 	command       string        // Name of command to handle
 	args          []string      // Arguments sent along with command
 	userInitiated bool          // If true, the user typed /command at the keyboard
 }
 
+// sentByUser returns true if the user sent command themselves, rather than it being sent for them,
+// such as notify being sent when someone mentions them.
+func (command *serverCommand) sentByUser() bool {
+	// say is internal, but only client handlers send it, with what the user typed
+	return command.userInitiated || command.command == "say"
+}
+
 // Initialize the commands and internalCommands map,
 // and add each command.
 func init() {
@@ -48,6 +55,8 @@ func init() {
 	internalCommands["adduser"] = cmdAdduser
 	internalCommands["rmuser"] = cmdRmuser
 	internalCommands["say"] = cmdSay
+	internalCommands["notify"] = cmdNotify
+	internalCommands["hostfound"] = cmdHostfound
 
 	// Map user accessible commands
 	commands["users"] = cmdUsers
@@ -59,23 +68,93 @@ func init() {
 	commands["whois"] = cmdWhois
 	commands["nick"] = cmdNick
 	commands["me"] = cmdMe
+	commands["msg"] = cmdMsg
+	commands["reply"] = cmdReply
+	commands["setmodpass"] = cmdSetmodpass
+	commands["op"] = cmdOp
+	commands["deop"] = cmdDeop
+	commands["kick"] = cmdKick
+	commands["ban"] = cmdBan
+	commands["unban"] = cmdUnban
+	commands["bans"] = cmdBans
+	commands["mute"] = cmdMute
+	commands["unmute"] = cmdUnmute
+	commands["topic"] = cmdTopic
+	commands["opentopic"] = cmdOpentopic
+	commands["register"] = cmdRegister
+	commands["passwd"] = cmdPasswd
+	commands["persist"] = cmdPersist
+	commands["history"] = cmdHistory
+	commands["log"] = cmdLog
+	commands["oper"] = cmdOper
+	commands["kill"] = cmdKill
+	commands["wall"] = cmdWall
+	commands["gban"] = cmdGban
+	commands["gunban"] = cmdGunban
+	commands["gbans"] = cmdGbans
+	commands["closeroom"] = cmdCloseroom
+	commands["forcenick"] = cmdForcenick
+	commands["sajoin"] = cmdSajoin
+	commands["audit"] = cmdAudit
+	commands["away"] = cmdAway
+	commands["back"] = cmdBack
+	commands["protocol"] = cmdProtocol
+	commands["color"] = cmdColor
+	commands["theme"] = cmdTheme
+	commands["mode"] = cmdMode
 }
 
 // Internal commands
 
 // cmdAdduser adds a user to the server
 var cmdAdduser commandHandlerFunc = func(server *server, command *serverCommand) {
+	if server.isShuttingDown() {
+		command.responseChan <- reply(server.farewell())
+		close(command.responseChan) // Signals client handler to kick user
+		return
+	}
+
 	// Convert to lowercase so people can't connect with the same nick with different case.
 	// This is only necessary for this map, since case-insensitive dupes will be filtered here.
 	if _, exists := server.clients[strings.ToLower(command.nick)]; exists {
-		command.responseChan <- []byte("That nick is already taken.\n")
+		command.responseChan <- errorReply("That nick is already taken.\n")
+		close(command.responseChan) // Signals client handler to kick user
+		return
+	}
+
+	operAccount := isOperAccount(server, command.client)
+	if ban := server.findGlobalBan(command.nick, clientHosts(command.client)); ban != nil && !operAccount {
+		message := fmt.Sprintf("You are banned from this server%s", describeExpiry(ban.expires))
+		if ban.reason != "" {
+			message += fmt.Sprintf(": %s", ban.reason)
+		}
+		log.Printf("Refused %s (%s): banned from the server\n", command.nick, command.client)
+		server.audit(command, auditEntry{Action: "connect-refused", Details: "Banned from the server"})
+		command.responseChan <- errorReply(message + "\n")
 		close(command.responseChan) // Signals client handler to kick user
 		return
 	}
 
 	server.clients[strings.ToLower(command.nick)] = command.client
 	server.userResponseChan[command.nick] = command.responseChan
-	command.responseChan <- []byte(fmt.Sprintf("%s\n\nWelcome %s\n", server.config.Motd, command.nick))
+	loadAccountPreferences(server, command.client)
+	transport, _ := command.client.GetVar("transport").(string)
+	details := fmt.Sprintf("Via %s", transport)
+	if command.client.VarExists("account") {
+		details += ", logged into their account"
+	}
+	server.audit(command, auditEntry{Action: "connect", Details: details})
+	command.responseChan <- &event{
+		Type: eventWelcome,
+		Time: time.Now(),
+		To:   command.nick,
+		Text: fmt.Sprintf("%s\n\nWelcome %s\n", server.config.Motd, command.nick),
+	}
+	if operAccount {
+		account, _ := command.client.GetVar("account").(string)
+		makeOper(server, command, account, "Logged into an operator account")
+		command.responseChan <- reply("You are a server operator.\n")
+	}
 }
 
 // cmdRmuser removes a user from the server
@@ -83,7 +162,7 @@ var cmdAdduser commandHandlerFunc = func(server *server, command *serverCommand)
 var cmdRmuser commandHandlerFunc = func(server *server, command *serverCommand) {
 	_, ok := server.clients[strings.ToLower(command.nick)]
 	if !ok {
-		command.responseChan <- []byte("That user doesn't exist\n")
+		command.responseChan <- errorReply("That user doesn't exist\n")
 		return
 	}
 
@@ -92,6 +171,7 @@ var cmdRmuser commandHandlerFunc = func(server *server, command *serverCommand)
 		reason = "User disconnected"
 	}
 
+	server.audit(command, auditEntry{Action: "disconnect", Details: reason})
 	roomName := server.userActiveRoom[command.nick]
 	if roomName != "" {
 		// Remove the user from the room they're in
@@ -106,31 +186,54 @@ var cmdRmuser commandHandlerFunc = func(server *server, command *serverCommand)
 // cmdSay says something in a room
 var cmdSay commandHandlerFunc = func(server *server, command *serverCommand) {
 	if len(command.args) < 2 {
-		command.responseChan <- []byte("You must specify a room to say something to.\n")
+		command.responseChan <- errorReply("You must specify a room to say something to.\n")
 		return
 	}
 
 	roomName := command.args[0]
 	message := strings.Join(command.args[1:], " ")
 
-	err := sayToRoom(server, roomName, fmt.Sprintf("%s: %s", command.nick, message))
+	if room, ok := server.rooms[strings.ToLower(roomName)]; ok && room.isMuted(command.nick, clientHosts(command.client)) {
+		command.responseChan <- errorReply("You are muted in this room.\n")
+		return
+	}
+
+	err := sendToRoom(server, roomName, fmt.Sprintf("%s: %s", command.nick, message), &event{Type: eventMessage, From: command.nick, Body: message})
 	if err != nil {
-		command.responseChan <- []byte(fmt.Sprintf("%s\n", err))
+		command.responseChan <- errorReply(fmt.Sprintf("%s\n", err))
 		return
 	}
 }
 
+// cmdNotify sends a message to a user, if they are still on the server.
+// It lets work done outside of the server's goroutine report back; see notifyLater.
+var cmdNotify commandHandlerFunc = func(server *server, command *serverCommand) {
+	// The user might have changed their nick while waiting
+	nick, ok := command.client.GetVar("nick").(string)
+	if !ok || server.clients[strings.ToLower(nick)] != command.client {
+		return
+	}
+
+	responseChan := server.userResponseChan[nick]
+	if responseChan == nil {
+		return
+	}
+
+	responseChan <- reply(strings.Join(command.args, " "))
+}
+
 // User commands
 
 // cmdUsers Lists users logged onto the server
 var cmdUsers commandHandlerFunc = func(server *server, command *serverCommand) {
 	if len(server.clients) == 0 {
-		command.responseChan <- []byte("Nobody is logged on. And yet, here you are... This shouldn't be happening!\n")
+		command.responseChan <- reply("Nobody is logged on. And yet, here you are... This shouldn't be happening!\n")
 		return
 	}
 
 	response := make([]string, 0, len(server.clients)+1)
-	response = append(response, "User\tRoom\tLast seen")
+	response = append(response, "User\tRoom\tLast seen\tAway")
+	users := make([]userInfo, 0, len(server.clients))
 
 	for nickLower, client := range server.clients {
 		// Try to get the real case of the nick
@@ -144,21 +247,29 @@ var cmdUsers commandHandlerFunc = func(server *server, command *serverCommand) {
 		if err != nil {
 			log.Printf("Error getting last seen value for nick %s, %s, %s\n", nick, client, err)
 		}
-		response = append(response, fmt.Sprintf("%s\t%s\t%s", nick, roomName, lastSeen))
+		away, _ := awayMessage(client)
+		response = append(response, fmt.Sprintf("%s\t%s\t%s\t%s", nick, roomName, lastSeen, away))
+		lastSeenTime, _ := client.GetVar("last_seen").(time.Time)
+		info := userInfo{Nick: nick, Room: roomName, LastSeen: lastSeenTime, Away: away}
+		if room, ok := server.rooms[strings.ToLower(roomName)]; ok {
+			info.Mod = isRoomMod(room, nick)
+		}
+		users = append(users, info)
 	}
 
-	command.responseChan <- []byte(strings.Join(response, "\n") + "\n")
+	command.responseChan <- &event{Type: eventUsers, Time: time.Now(), Text: strings.Join(response, "\n") + "\n", Data: users}
 }
 
 // cmdRooms Lists all rooms on the server
 var cmdRooms commandHandlerFunc = func(server *server, command *serverCommand) {
 	if len(server.rooms) == 0 {
-		command.responseChan <- []byte("There are no rooms. Why not create the first?\n")
+		command.responseChan <- reply("There are no rooms. Why not create the first?\n")
 		return
 	}
 
 	response := make([]string, 0, len(server.rooms)+1)
 	response = append(response, "Rooms:")
+	rooms := make([]*roomInfo, 0, len(server.rooms))
 
 	for _, room := range server.rooms {
 		var access string
@@ -168,17 +279,25 @@ var cmdRooms commandHandlerFunc = func(server *server, command *serverCommand) {
 			access = "public"
 		}
 
+		if room.persistent {
+			access += ", permanent"
+		}
+		if room.logging {
+			access += ", logged"
+		}
+
 		response = append(response, fmt.Sprintf("%s\t%s", room.name, access))
+		rooms = append(rooms, room.info(false))
 	}
 
-	command.responseChan <- []byte(strings.Join(response, "\n") + "\n")
+	command.responseChan <- &event{Type: eventRooms, Time: time.Now(), Text: strings.Join(response, "\n") + "\n", Data: rooms}
 }
 
 // cmdCreate Creates a new room,
 // And adds the creater to it as a moderator
 var cmdCreate commandHandlerFunc = func(server *server, command *serverCommand) {
 	if len(command.args) < 1 {
-		command.responseChan <- []byte("Use /create <name> [<topic> [<roompass>]]\nRoompass will only apply until the room is destroyed.")
+		command.responseChan <- errorReply("Use /create <name> [<topic> [<roompass>]]\nRoompass will only apply until the room is destroyed.")
 		return
 	}
 
@@ -191,49 +310,54 @@ var cmdCreate commandHandlerFunc = func(server *server, command *serverCommand)
 		roomPass = command.args[2]
 	}
 
-	for _, r := range name {
-		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
-			command.responseChan <- []byte("Room names can contain only letters and numbers\n")
-			return
-		}
+	if !isValidRoomName(name) {
+		command.responseChan <- errorReply("Room names can contain only letters and numbers\n")
+		return
 	}
 
 	_, exists := server.rooms[strings.ToLower(name)]
 	if exists {
-		command.responseChan <- []byte("That room already exists\n")
+		command.responseChan <- errorReply("That room already exists\n")
 		return
 	}
 
-	room := room{
-		creater:  command.nick,
-		mods:     make(map[string]struct{}),
-		users:    make(map[string]struct{}),
-		name:     name,
-		topic:    topic,
-		roomPass: roomPass,
+	room := newRoom(name, command.nick, server.config.HistorySize)
+	room.roomPass = roomPass
+	room.logging = server.config.LogNewRooms && server.roomLogger != nil
+	if topic != "" {
+		room.topic = roomTopic{text: topic, setBy: command.nick, setAt: time.Now()}
 	}
 
 	oldRoomName, ok := server.userActiveRoom[command.nick]
 	if ok {
 		err := leaveRoom(server, command.nick, oldRoomName, "")
 		if err != nil {
-			command.responseChan <- []byte(fmt.Sprintf("Error leaving old room: %s\n", err))
+			command.responseChan <- errorReply(fmt.Sprintf("Error leaving old room: %s\n", err))
 			return
 		}
 	}
 
-	room.mods[command.nick] = struct{}{}
-
-	server.rooms[strings.ToLower(name)] = &room
+	server.rooms[strings.ToLower(name)] = room
 	server.userActiveRoom[command.nick] = name
-
-	command.responseChan <- []byte(fmt.Sprintf("Joined %s; topic: %s\n", name, topic))
+	makeRoomMod(server, room, command.nick)
+	server.audit(command, auditEntry{Action: "room-create", Room: room.name})
+
+	command.responseChan <- &event{
+		Type: eventJoined,
+		Time: time.Now(),
+		Room: room.name,
+		Text: fmt.Sprintf("Joined %s; topic: %s\n", name, topic),
+		Data: room.info(true),
+	}
+	if room.logging {
+		command.responseChan <- reply("This room is logged; everything said here is saved on the server.\n")
+	}
 }
 
 // cmdJoin joins a room
 var cmdJoin commandHandlerFunc = func(server *server, command *serverCommand) {
 	if len(command.args) < 1 {
-		command.responseChan <- []byte("Which room do you want to join?\n")
+		command.responseChan <- errorReply("Which room do you want to join?\n")
 		return
 	}
 
@@ -245,69 +369,111 @@ var cmdJoin commandHandlerFunc = func(server *server, command *serverCommand) {
 
 	room, ok := server.rooms[strings.ToLower(roomName)]
 	if !ok {
-		command.responseChan <- []byte("That room doesn't exist\n")
+		command.responseChan <- errorReply("That room doesn't exist\n")
 		return
 	}
 
 	_, isMod := room.mods[command.nick]
 	if isMod {
-		command.responseChan <- []byte("You are already in that room as a moderator\n")
+		command.responseChan <- errorReply("You are already in that room as a moderator\n")
 		return
 	}
 	_, isUser := room.users[command.nick]
 	if isUser {
-		command.responseChan <- []byte("You are already in that room\n")
+		command.responseChan <- errorReply("You are already in that room\n")
+		return
+	}
+
+	if ban := room.findBan(command.nick, clientHosts(command.client)); ban != nil {
+		message := fmt.Sprintf("You are banned from %s%s", room.name, describeExpiry(ban.expires))
+		if ban.reason != "" {
+			message += fmt.Sprintf(": %s", ban.reason)
+		}
+		command.responseChan <- errorReply(message + "\n")
 		return
 	}
 
 	if room.roomPass != "" {
 		if roomPass == "" {
-			command.responseChan <- []byte(fmt.Sprintf("That room is private.\nType /join %s <roompass> to get in.\n", room.name))
+			command.responseChan <- errorReply(fmt.Sprintf("That room is private.\nType /join %s <roompass> to get in.\n", room.name))
 			return
 		} else if room.roomPass != roomPass {
-			command.responseChan <- []byte("Wrong password.\n")
+			server.audit(command, auditEntry{Action: "password-failed", Room: room.name, Details: "Wrong room password"})
+			command.responseChan <- errorReply("Wrong password.\n")
 			return
 		}
 	}
 
+	joinRoom(server, command, room)
+}
+
+// joinRoom puts the user who sent command into a room, taking them out of the one they were in.
+// Bans and room passwords must already have been checked.
+func joinRoom(server *server, command *serverCommand, room *room) {
 	oldRoomName, ok := server.userActiveRoom[command.nick]
 	if ok {
 		err := leaveRoom(server, command.nick, oldRoomName, "")
 		if err != nil {
-			command.responseChan <- []byte(fmt.Sprintf("Error leaving old room: %s\n", err))
+			command.responseChan <- errorReply(fmt.Sprintf("Error leaving old room: %s\n", err))
 			return
 		}
 	}
 
-	room.users[command.nick] = struct{}{}
+	if _, isModAccount := room.modAccounts[strings.ToLower(userAccount(server, command.nick))]; isModAccount {
+		room.mods[command.nick] = struct{}{}
+	} else {
+		room.users[command.nick] = struct{}{}
+	}
 	server.userActiveRoom[command.nick] = room.name
 
-	err := sayToRoom(server, roomName, fmt.Sprintf("%s has joined the room", command.nick))
+	// Get the backlog before announcing the user, so they don't see their own arrival in it
+	backlog := room.history.last(server.config.HistoryReplayLines)
+	err := sendToRoom(server, room.name, fmt.Sprintf("%s has joined the room", command.nick), &event{Type: eventJoin, From: command.nick})
 	if err != nil {
-		command.responseChan <- []byte(fmt.Sprintf("Error while joining room: %s\n", err))
+		command.responseChan <- errorReply(fmt.Sprintf("Error while joining room: %s\n", err))
+		delete(room.mods, command.nick)
 		delete(room.users, command.nick)
 		delete(server.userActiveRoom, command.nick)
 		return
 	}
 
-	command.responseChan <- []byte(fmt.Sprintf("Joined %s; topic: %s\n", room.name, room.topic))
+	command.responseChan <- &event{
+		Type: eventJoined,
+		Time: time.Now(),
+		Room: room.name,
+		Text: fmt.Sprintf("Joined %s; topic: %s\n", room.name, room.topic.text),
+		Data: room.info(true),
+	}
+	if room.logging {
+		command.responseChan <- reply("This room is logged; everything said here is saved on the server.\n")
+	}
+	if len(backlog) > 0 {
+		command.responseChan <- reply(formatHistory("Recently in this room:", backlog))
+	}
 }
 
 // cmdLeave leaves a room
 var cmdLeave commandHandlerFunc = func(server *server, command *serverCommand) {
 	roomName, ok := server.userActiveRoom[command.nick]
 	if !ok {
-		command.responseChan <- []byte("You aren't in a room\n")
+		command.responseChan <- errorReply("You aren't in a room\n")
 		return
 	}
 
 	err := leaveRoom(server, command.nick, roomName, strings.Join(command.args, " "))
 	if err != nil {
-		command.responseChan <- []byte(fmt.Sprintf("Error leaving room: %s\n", err))
+		command.responseChan <- errorReply(fmt.Sprintf("Error leaving room: %s\n", err))
 		return
 	}
 
-	command.responseChan <- []byte(fmt.Sprintf("Left %s\n", roomName))
+	command.responseChan <- &event{
+		Type: eventLeave,
+		Time: time.Now(),
+		Room: roomName,
+		From: command.nick,
+		Body: strings.Join(command.args, " "),
+		Text: fmt.Sprintf("Left %s\n", roomName),
+	}
 }
 
 // cmdQuit Quits the server.
@@ -344,7 +510,7 @@ var cmdWhois commandHandlerFunc = func(server *server, command *serverCommand) {
 
 	client, ok := server.clients[strings.ToLower(nick)]
 	if !ok {
-		command.responseChan <- []byte("That user doesn't exist.\n")
+		command.responseChan <- errorReply("That user doesn't exist.\n")
 		return
 	}
 
@@ -353,38 +519,71 @@ var cmdWhois commandHandlerFunc = func(server *server, command *serverCommand) {
 		nick = nickCorrect
 	}
 
-	var remoteAddr string
-	remoteAddr, ok = client.GetVar("remote_addr").(string)
+	remoteAddr := describeHost(client)
 
 	roomName := server.userActiveRoom[nick]
 	lastSeen, _ := getLastSeen(server, client)
 
-	whoisInfo := make([]string, 0, 4)
+	lastSeenTime, _ := client.GetVar("last_seen").(time.Time)
+	info := &whoisInfo{Nick: nick, Host: remoteAddr, Room: roomName, LastSeen: lastSeenTime}
+	whoisInfo := make([]string, 0, 9)
 
 	whoisInfo = append(whoisInfo, fmt.Sprintf("User %s:", nick))
 	if remoteAddr != "" {
 		whoisInfo = append(whoisInfo, remoteAddr)
 	}
+	if transport, ok := client.GetVar("transport").(string); ok {
+		whoisInfo = append(whoisInfo, fmt.Sprintf("Connected via: %s", transport))
+		info.Transport = transport
+	}
+	if terminal := describeTerminal(client); terminal != "" {
+		whoisInfo = append(whoisInfo, fmt.Sprintf("Terminal: %s", terminal))
+		info.TerminalType, _ = client.GetVar("terminal_type").(string)
+		info.WindowWidth, _ = client.GetVar("window_width").(int)
+		info.WindowHeight, _ = client.GetVar("window_height").(int)
+	}
+	if compression := describeCompression(client); compression != "" {
+		whoisInfo = append(whoisInfo, fmt.Sprintf("Compression: %s", compression))
+		if t, ok := client.GetVar("telnet").(*telnetConn); ok {
+			info.UncompressedBytes, info.CompressedBytes, _ = t.compressionStats()
+		}
+	}
+	if account, ok := client.GetVar("account").(string); ok {
+		whoisInfo = append(whoisInfo, fmt.Sprintf("Logged in as: %s", account))
+		info.Account = account
+	}
+	if isOper(client) {
+		whoisInfo = append(whoisInfo, "Server operator")
+		info.Operator = true
+	}
 	if roomName != "" {
 		whoisInfo = append(whoisInfo, fmt.Sprintf("Room: %s", roomName))
 	}
 	if lastSeen != "" {
 		whoisInfo = append(whoisInfo, fmt.Sprintf("Last seen: %s", lastSeen))
 	}
+	if away := describeAway(client); away != "" {
+		whoisInfo = append(whoisInfo, away)
+		info.Away, _ = awayMessage(client)
+	}
+	if queue, ok := client.GetVar("send_queue").(*sendQueue); ok {
+		whoisInfo = append(whoisInfo, fmt.Sprintf("Dropped messages: %d", queue.Dropped()))
+		info.Dropped = queue.Dropped()
+	}
 
-	command.responseChan <- []byte(strings.Join(whoisInfo, "\n") + "\n")
+	command.responseChan <- &event{Type: eventWhois, Time: time.Now(), Text: strings.Join(whoisInfo, "\n") + "\n", Data: info}
 }
 
 // cmdNick changes a user's nick
 var cmdNick commandHandlerFunc = func(server *server, command *serverCommand) {
 	if len(command.args) < 1 {
-		command.responseChan <- []byte("What do you want to change your nick to?\n")
+		command.responseChan <- errorReply("What do you want to change your nick to?\n")
 		return
 	}
 	nick := command.args[0]
 	for _, r := range nick {
 		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
-			command.responseChan <- []byte("Nicks can contain only letters and numbers\n")
+			command.responseChan <- errorReply("Nicks can contain only letters and numbers\n")
 			return
 		}
 	}
@@ -392,16 +591,46 @@ var cmdNick commandHandlerFunc = func(server *server, command *serverCommand) {
 	// Convert to lowercase so people can't connect with the same nick with different case.
 	// This is only necessary for this map, since case-insensitive dupes will be filtered here.
 	if _, exists := server.clients[strings.ToLower(nick)]; exists {
-		command.responseChan <- []byte("That nick is already taken.\n")
+		command.responseChan <- errorReply("That nick is already taken.\n")
+		return
+	}
+	if ban := server.findGlobalBan(nick, nil); ban != nil && !isOper(command.client) {
+		command.responseChan <- errorReply("That nick is banned from this server.\n")
 		return
 	}
 
+	if store := server.config.AccountStore; store != nil {
+		account, err := store.Account(nick)
+		if err == nil {
+			loggedInAs, _ := command.client.GetVar("account").(string)
+			if !strings.EqualFold(loggedInAs, account.Nick) {
+				command.responseChan <- errorReply("That nick is registered. To use it, reconnect with it and enter its password.\n")
+				return
+			}
+			nick = account.Nick
+		} else if err != ErrNoAccount {
+			log.Printf("Error looking up account for %s: %s\n", nick, err)
+			command.responseChan <- errorReply("Cannot check if that nick is registered; try again later.\n")
+			return
+		}
+	}
+
+	server.audit(command, auditEntry{Action: "nick", Target: nick})
 	server.clients[strings.ToLower(nick)] = command.client
 	delete(server.clients, strings.ToLower(command.nick))
 	server.userResponseChan[nick] = command.responseChan
 	delete(server.userResponseChan, command.nick)
 	command.client.SetVar("nick", nick)
 
+	// Mutes follow the user to their new nick, even in rooms they aren't in
+	for _, room := range server.rooms {
+		for _, mute := range room.mutes {
+			if strings.EqualFold(mute.nick, command.nick) {
+				mute.nick = nick
+			}
+		}
+	}
+
 	roomName := server.userActiveRoom[command.nick]
 	if roomName != "" {
 		// User is in a room
@@ -420,57 +649,435 @@ var cmdNick commandHandlerFunc = func(server *server, command *serverCommand) {
 			}
 			if room.creater == command.nick {
 				room.creater = nick
+				server.roomChanged(room)
 			}
 		}
-		sayToRoom(server, roomName, fmt.Sprintf("%s is now known as %s", command.nick, nick))
+		sendToRoom(server, roomName, fmt.Sprintf("%s is now known as %s", command.nick, nick), &event{Type: eventNick, From: command.nick, To: nick})
 	} else {
-		command.responseChan <- []byte(fmt.Sprintf("You are now known as %s\n", nick))
+		command.responseChan <- &event{
+			Type: eventNick,
+			Time: time.Now(),
+			From: command.nick,
+			To:   nick,
+			Text: fmt.Sprintf("You are now known as %s\n", nick),
+		}
 	}
 }
 
 // cmdMe sends an emote in the form "<nick> <message>"
 var cmdMe commandHandlerFunc = func(server *server, command *serverCommand) {
 	if len(command.args) < 1 {
-		command.responseChan <- []byte("Try something like \"/me sits down\" without the quotes.\n")
+		command.responseChan <- errorReply("Try something like \"/me sits down\" without the quotes.\n")
 		return
 	}
 
 	action := strings.Join(command.args, " ")
 	roomName, ok := server.userActiveRoom[command.nick]
 	if !ok {
-		command.responseChan <- []byte("You must be in a room to do that.\n")
+		command.responseChan <- errorReply("You must be in a room to do that.\n")
+		return
+	}
+	if room, ok := server.rooms[strings.ToLower(roomName)]; ok && room.isMuted(command.nick, clientHosts(command.client)) {
+		command.responseChan <- errorReply("You are muted in this room.\n")
+		return
+	}
+
+	sendToRoom(server, roomName, fmt.Sprintf("%s %s", command.nick, action), &event{Type: eventAction, From: command.nick, Body: action})
+}
+
+// cmdMsg sends a private message to another user, no matter which room they're in
+var cmdMsg commandHandlerFunc = func(server *server, command *serverCommand) {
+	if len(command.args) < 2 {
+		command.responseChan <- errorReply("Use /msg <nick> <message>\n")
+		return
+	}
+
+	nick := command.args[0]
+	client, ok := server.clients[strings.ToLower(nick)]
+	if !ok {
+		command.responseChan <- errorReply("That user doesn't exist.\n")
+		return
+	}
+
+	// Try to get correct case of nick
+	if nickCorrect, ok := client.GetVar("nick").(string); ok {
+		nick = nickCorrect
+	}
+
+	if nick == command.nick {
+		command.responseChan <- errorReply("Talking to yourself again?\n")
+		return
+	}
+
+	responseChan := server.userResponseChan[nick]
+	if responseChan == nil {
+		command.responseChan <- errorReply("That user doesn't exist.\n")
+		return
+	}
+
+	message := strings.Join(command.args[1:], " ")
+	now := time.Now()
+	responseChan <- &event{
+		Type: eventPrivate,
+		Time: now,
+		From: command.nick,
+		To:   nick,
+		Body: message,
+		Text: formatMessage(fmt.Sprintf("[from %s] %s", command.nick, message)),
+	}
+	client.SetVar("reply_to", command.nick)
+	command.responseChan <- &event{
+		Type: eventPrivate,
+		Time: now,
+		From: command.nick,
+		To:   nick,
+		Body: message,
+		Text: formatMessage(fmt.Sprintf("[to %s] %s", nick, message)),
+	}
+	if away, ok := awayMessage(client); ok {
+		command.responseChan <- &event{Type: eventAway, Time: now, From: nick, Body: away, Text: fmt.Sprintf("%s is away: %s\n", nick, away)}
+	}
+}
+
+// cmdReply sends a private message to the last user who sent one to this user
+var cmdReply commandHandlerFunc = func(server *server, command *serverCommand) {
+	if len(command.args) < 1 {
+		command.responseChan <- errorReply("Use /reply <message>\n")
+		return
+	}
+
+	replyTo, ok := command.client.GetVar("reply_to").(string)
+	if !ok {
+		command.responseChan <- errorReply("Nobody has sent you a private message yet.\n")
+		return
+	}
+
+	newCommand := &serverCommand{
+		nick:          command.nick,
+		client:        command.client,
+		responseChan:  command.responseChan,
+		command:       command.command,
+		args:          append([]string{replyTo}, command.args...),
+		userInitiated: command.userInitiated,
+	}
+
+	cmdMsg(server, newCommand)
+}
+
+// cmdSetmodpass sets the password members can use to become a moderator of the room
+var cmdSetmodpass commandHandlerFunc = func(server *server, command *serverCommand) {
+	room, ok := getActiveRoom(server, command.nick)
+	if !ok {
+		command.responseChan <- errorReply("You must be in a room to do that.\n")
+		return
+	}
+	if !isRoomMod(room, command.nick) {
+		command.responseChan <- errorReply("Only moderators can do that.\n")
+		return
+	}
+	if len(command.args) < 1 {
+		command.responseChan <- errorReply("Use /setmodpass <modpass>\nMembers can then become moderators with /op <modpass>. Use /setmodpass \"\" to remove it.\n")
+		return
+	}
+
+	room.modPass = command.args[0]
+	server.roomChanged(room)
+	if room.modPass == "" {
+		command.responseChan <- reply("Moderator password removed.\n")
+		return
+	}
+
+	command.responseChan <- reply("Moderator password set.\n")
+}
+
+// cmdOp makes a member of the room a moderator.
+// Moderators can op other members by nick; other members can op themselves with the room's moderator password.
+var cmdOp commandHandlerFunc = func(server *server, command *serverCommand) {
+	if len(command.args) < 1 {
+		command.responseChan <- errorReply("Use /op <nick> to make someone a moderator, or /op <modpass> to become one.\n")
+		return
+	}
+
+	room, ok := getActiveRoom(server, command.nick)
+	if !ok {
+		command.responseChan <- errorReply("You must be in a room to do that.\n")
+		return
+	}
+
+	if !isRoomMod(room, command.nick) {
+		if room.modPass == "" {
+			command.responseChan <- errorReply("This room has no moderator password.\n")
+			return
+		}
+		if room.modPass != command.args[0] {
+			server.audit(command, auditEntry{Action: "password-failed", Room: room.name, Details: "Wrong moderator password"})
+			command.responseChan <- errorReply("Wrong password.\n")
+			return
+		}
+
+		makeRoomMod(server, room, command.nick)
+		server.audit(command, auditEntry{Action: "op", Target: command.nick, Room: room.name, Details: "With the moderator password"})
+		sayToRoom(server, room.name, fmt.Sprintf("%s is now a moderator", command.nick))
+		return
+	}
+
+	nick, ok := findRoomMember(room, command.args[0])
+	if !ok {
+		command.responseChan <- errorReply("That user isn't in this room.\n")
+		return
+	}
+	if isRoomMod(room, nick) {
+		command.responseChan <- errorReply(fmt.Sprintf("%s is already a moderator.\n", nick))
+		return
+	}
+
+	makeRoomMod(server, room, nick)
+	server.audit(command, auditEntry{Action: "op", Target: nick, Room: room.name})
+	sayToRoom(server, room.name, fmt.Sprintf("%s made %s a moderator", command.nick, nick))
+}
+
+// cmdDeop takes moderator status away from a member of the room
+var cmdDeop commandHandlerFunc = func(server *server, command *serverCommand) {
+	if len(command.args) < 1 {
+		command.responseChan <- errorReply("Use /deop <nick>\n")
+		return
+	}
+
+	room, ok := getActiveRoom(server, command.nick)
+	if !ok {
+		command.responseChan <- errorReply("You must be in a room to do that.\n")
+		return
+	}
+	if !isRoomMod(room, command.nick) {
+		command.responseChan <- errorReply("Only moderators can do that.\n")
+		return
+	}
+
+	nick, ok := findRoomMember(room, command.args[0])
+	if !ok {
+		command.responseChan <- errorReply("That user isn't in this room.\n")
+		return
+	}
+	if !isRoomMod(room, nick) {
+		command.responseChan <- errorReply(fmt.Sprintf("%s isn't a moderator.\n", nick))
 		return
 	}
 
-	sayToRoom(server, roomName, fmt.Sprintf("%s %s", command.nick, action))
+	removeRoomMod(server, room, nick)
+	server.audit(command, auditEntry{Action: "deop", Target: nick, Room: room.name})
+	if nick == command.nick {
+		sayToRoom(server, room.name, fmt.Sprintf("%s is no longer a moderator", nick))
+	} else {
+		sayToRoom(server, room.name, fmt.Sprintf("%s removed %s as a moderator", command.nick, nick))
+	}
+}
+
+// cmdTopic shows or changes the room's topic.
+// "/topic history" shows the topics the room had before.
+var cmdTopic commandHandlerFunc = func(server *server, command *serverCommand) {
+	room, ok := getActiveRoom(server, command.nick)
+	if !ok {
+		command.responseChan <- errorReply("You must be in a room to do that.\n")
+		return
+	}
+
+	if len(command.args) == 0 {
+		if room.topic.text == "" {
+			command.responseChan <- reply(fmt.Sprintf("%s has no topic.\n", room.name))
+			return
+		}
+
+		command.responseChan <- reply(fmt.Sprintf("Topic for %s: %s\n%s\n", room.name, room.topic.text, room.topic.attribution()))
+		return
+	}
+
+	if len(command.args) == 1 && command.args[0] == "history" {
+		if len(room.topicHistory) == 0 {
+			command.responseChan <- reply(fmt.Sprintf("%s has had no other topics.\n", room.name))
+			return
+		}
+
+		response := make([]string, 0, len(room.topicHistory)+1)
+		response = append(response, fmt.Sprintf("Previous topics for %s, oldest first:", room.name))
+		for _, topic := range room.topicHistory {
+			response = append(response, fmt.Sprintf("%s\t%s", topic.text, topic.attribution()))
+		}
+
+		command.responseChan <- reply(strings.Join(response, "\n") + "\n")
+		return
+	}
+
+	if !room.openTopic && !isRoomMod(room, command.nick) {
+		command.responseChan <- errorReply("Only moderators can change the topic in this room.\n")
+		return
+	}
+
+	if room.topic.text != "" {
+		room.topicHistory = append(room.topicHistory, room.topic)
+		if excess := len(room.topicHistory) - server.config.TopicHistorySize; excess > 0 {
+			room.topicHistory = room.topicHistory[excess:]
+		}
+	}
+
+	text := strings.Join(command.args, " ")
+	room.topic = roomTopic{text: text, setBy: command.nick, setAt: time.Now()}
+	server.roomChanged(room)
+	topicEvent := &event{Type: eventTopic, From: command.nick, Body: text}
+	if text == "" {
+		sendToRoom(server, room.name, fmt.Sprintf("%s removed the topic", command.nick), topicEvent)
+		return
+	}
+
+	sendToRoom(server, room.name, fmt.Sprintf("%s changed the topic to: %s", command.nick, text), topicEvent)
+}
+
+// cmdOpentopic decides whether everyone in the room can change its topic, or only moderators
+var cmdOpentopic commandHandlerFunc = func(server *server, command *serverCommand) {
+	if len(command.args) < 1 || (command.args[0] != "on" && command.args[0] != "off") {
+		command.responseChan <- errorReply("Use /opentopic on|off\n")
+		return
+	}
+
+	room, ok := getModeratedRoom(server, command)
+	if !ok {
+		return
+	}
+
+	room.openTopic = command.args[0] == "on"
+	server.roomChanged(room)
+	if room.openTopic {
+		sayToRoom(server, room.name, fmt.Sprintf("%s let everyone change the topic", command.nick))
+	} else {
+		sayToRoom(server, room.name, fmt.Sprintf("%s made the topic changeable only by moderators", command.nick))
+	}
 }
 
 // Helper functions
 
-// sayToRoom says something to all members in a room
+// notifyLater sends a message to the user who ran command, if they are still on the server.
+// Use this from goroutines started by commands, instead of sending to command.responseChan,
+// which is closed when the user leaves.
+func notifyLater(server *server, command *serverCommand, message string) {
+	server.in <- &serverCommand{
+		nick:         command.nick,
+		client:       command.client,
+		responseChan: command.responseChan,
+		command:      "notify",
+		args:         []string{message},
+	}
+}
+
+// getActiveRoom gets the room a user is currently in
+func getActiveRoom(server *server, nick string) (*room, bool) {
+	roomName, ok := server.userActiveRoom[nick]
+	if !ok {
+		return nil, false
+	}
+
+	room, ok := server.rooms[strings.ToLower(roomName)]
+	return room, ok
+}
+
+// makeRoomMod makes a member of a room a moderator.
+// If they are logged into an account, the room remembers the account,
+// and makes them a moderator whenever they join.
+func makeRoomMod(server *server, room *room, nick string) {
+	delete(room.users, nick)
+	room.mods[nick] = struct{}{}
+	if account := userAccount(server, nick); account != "" {
+		room.modAccounts[strings.ToLower(account)] = struct{}{}
+		server.roomChanged(room)
+	}
+}
+
+// removeRoomMod makes a moderator a regular member of the room
+func removeRoomMod(server *server, room *room, nick string) {
+	delete(room.mods, nick)
+	room.users[nick] = struct{}{}
+	if account := userAccount(server, nick); account != "" {
+		delete(room.modAccounts, strings.ToLower(account))
+		server.roomChanged(room)
+	}
+}
+
+// userAccount gets the account a user is logged into, or "" if they aren't logged in
+func userAccount(server *server, nick string) string {
+	client, ok := server.clients[strings.ToLower(nick)]
+	if !ok {
+		return ""
+	}
+
+	account, _ := client.GetVar("account").(string)
+	return account
+}
+
+// isRoomMod returns true if nick is a moderator of the room
+func isRoomMod(room *room, nick string) bool {
+	_, isMod := room.mods[nick]
+	return isMod
+}
+
+// findRoomMember looks up a member of a room, ignoring case.
+// Returns the member's nick as it appears in the room.
+func findRoomMember(room *room, nick string) (string, bool) {
+	for member := range room.mods {
+		if strings.EqualFold(member, nick) {
+			return member, true
+		}
+	}
+	for member := range room.users {
+		if strings.EqualFold(member, nick) {
+			return member, true
+		}
+	}
+
+	return "", false
+}
+
+// formatMessage prepares a message to be sent to a user.
+// Lines after the first are indented, so it's clear where a multiline message starts and ends.
+func formatMessage(message string) string {
+	message = strings.Replace(message, "\n", "\n    ", -1) // -1 replaces all instances
+	return message + "\n"
+}
+
+// sayToRoom tells all members in a room that something happened
 func sayToRoom(server *server, roomName, message string) error {
+	return sendToRoom(server, roomName, message, &event{Type: eventNotice})
+}
+
+// sendToRoom sends an event to all members in a room.
+// message is how the event is shown to line-based clients, and how it is remembered in the room's history and logs.
+// The event's room, time and text are filled in.
+func sendToRoom(server *server, roomName, message string, ev *event) error {
 	room, ok := server.rooms[strings.ToLower(roomName)]
 	if !ok {
 		return fmt.Errorf("Room doesn't exist")
 	}
 
+	room.history.add(message)
+	if room.logging && server.roomLogger != nil {
+		server.roomLogger.log(room.name, message)
+	}
+
+	ev.Room = room.name
+	ev.Time = time.Now()
 	// Indent each line, except for the first
-	message = strings.Replace(message, "\n", "\n    ", -1) // -1 replaces all instances
-	message += "\n"
+	ev.Text = formatMessage(message)
 
 	for nick, _ := range room.mods {
 		responseChan := server.userResponseChan[nick]
 		if responseChan == nil {
 			continue
 		}
-		responseChan <- []byte(message)
+		responseChan <- ev
 	}
 	for nick, _ := range room.users {
 		responseChan := server.userResponseChan[nick]
 		if responseChan == nil {
 			continue
 		}
-		responseChan <- []byte(message)
+		responseChan <- ev
 	}
 
 	return nil
@@ -495,16 +1102,40 @@ func leaveRoom(server *server, nick, roomName, reason string) error {
 	delete(room.users, nick)
 	delete(server.userActiveRoom, nick)
 
-	sayToRoom(server, roomName, strings.Join(message, ""))
+	sendToRoom(server, roomName, strings.Join(message, ""), &event{Type: eventLeave, From: nick, Body: reason})
 
-	// If the room is empty, delete it.
-	if (len(room.mods) + len(room.users)) == 0 {
-		delete(server.rooms, strings.ToLower(roomName))
+	// If the room is empty, delete it, unless it's meant to stay.
+	if (len(room.mods)+len(room.users)) == 0 && !room.persistent {
+		deleteRoom(server, room)
+		server.auditLogger.log(auditEntry{Action: "room-destroy", Nick: nick, Room: room.name, Details: "Everyone left"})
 	}
 
 	return nil
 }
 
+// isValidRoomName returns true if name can be used for a room.
+// Room names are also used in paths, such as for logs, so they must never contain anything else.
+func isValidRoomName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// deleteRoom removes a room from the server, closing its log file
+func deleteRoom(server *server, room *room) {
+	delete(server.rooms, strings.ToLower(room.name))
+	if server.roomLogger != nil {
+		server.roomLogger.closeFile(strings.ToLower(room.name))
+	}
+}
+
 // getLastSeen Gets the time the server last received anything from the user
 func getLastSeen(server *server, client *Client) (string, error) {
 	if !client.VarExists("last_seen") {
@@ -516,14 +1147,19 @@ func getLastSeen(server *server, client *Client) (string, error) {
 		return "", fmt.Errorf("Couldn't get last seen time")
 	}
 
-	sinceLastSeen := time.Since(lastSeenTime)
+	return describeTimeSince(lastSeenTime), nil
+}
+
+// describeTimeSince describes how long ago t was, for example "3 minutes ago"
+func describeTimeSince(t time.Time) string {
+	since := time.Since(t)
 
-	if (sinceLastSeen / time.Minute) < 1 {
-		return "Just now", nil
+	if (since / time.Minute) < 1 {
+		return "Just now"
 	}
 
-	if (sinceLastSeen / time.Hour) < 1 {
-		numMinutes := sinceLastSeen / time.Minute
+	if (since / time.Hour) < 1 {
+		numMinutes := since / time.Minute
 		var minutes string
 		if numMinutes == 1 {
 			minutes = "minute"
@@ -531,12 +1167,12 @@ func getLastSeen(server *server, client *Client) (string, error) {
 			minutes = "minutes"
 		}
 
-		return fmt.Sprintf("%d %s ago", numMinutes, minutes), nil
+		return fmt.Sprintf("%d %s ago", numMinutes, minutes)
 	}
 
-	if (sinceLastSeen / time.Hour) < 24 {
-		numHours := sinceLastSeen / time.Hour
-		numMinutes := (sinceLastSeen / time.Minute) - (numHours * 60)
+	if (since / time.Hour) < 24 {
+		numHours := since / time.Hour
+		numMinutes := (since / time.Minute) - (numHours * 60)
 		var hours string
 		if numHours == 1 {
 			hours = "hour"
@@ -550,12 +1186,12 @@ func getLastSeen(server *server, client *Client) (string, error) {
 			minutes = "minutes"
 		}
 
-		return fmt.Sprintf("%d %s, %d %s ago", numHours, hours, numMinutes, minutes), nil
+		return fmt.Sprintf("%d %s, %d %s ago", numHours, hours, numMinutes, minutes)
 	}
 
-	numDays := sinceLastSeen / (time.Hour * 24)
-	numHours := (sinceLastSeen / time.Hour) - (numDays * 24)
-	numMinutes := (sinceLastSeen / time.Minute) - (((numDays * 24) + numHours) * 60)
+	numDays := since / (time.Hour * 24)
+	numHours := (since / time.Hour) - (numDays * 24)
+	numMinutes := (since / time.Minute) - (((numDays * 24) + numHours) * 60)
 	var days string
 	if numDays == 1 {
 		days = "day"
@@ -575,5 +1211,5 @@ func getLastSeen(server *server, client *Client) (string, error) {
 		minutes = "minutes"
 	}
 
-	return fmt.Sprintf("%d %s, %d %s, %d %s ago", numDays, days, numHours, hours, numMinutes, minutes), nil
+	return fmt.Sprintf("%d %s, %d %s, %d %s ago", numDays, days, numHours, hours, numMinutes, minutes)
 }
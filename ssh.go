@@ -0,0 +1,392 @@
+package chatsrv
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// Time allowed for an SSH client to finish the handshake and log in
+const sshHandshakeTimeout = 30 * time.Second
+
+// serveSSH runs the SSH listener on config.SSHBindAddr.
+// Users log in with a public key listed for their nick in config.SSHAuthorizedKeysFile,
+// and their SSH username becomes their nick.
+func (server *server) serveSSH() {
+	sshConfig := &ssh.ServerConfig{PublicKeyCallback: server.checkSSHKey}
+	hostKey, err := loadOrCreateSSHHostKey(server.config.SSHHostKeyFile)
+	if err != nil {
+		log.Printf("Cannot start the SSH listener: %s\n", err)
+		return
+	}
+	sshConfig.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", server.config.SSHBindAddr)
+	if err != nil {
+		log.Printf("Cannot start the SSH listener, binding on %s; %s\n", server.config.SSHBindAddr, err)
+		return
+	}
+	defer listener.Close()
+
+	server.runningLock.Lock()
+	if server.shuttingDown {
+		server.runningLock.Unlock()
+		return
+	}
+	server.sshListener = listener
+	server.runningLock.Unlock()
+	log.Printf("Listening for SSH on %s\n", server.config.SSHBindAddr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if server.isShuttingDown() {
+				log.Printf("Stopped listening for SSH on %s\n", server.config.SSHBindAddr)
+				return
+			}
+			log.Printf("Error accepting SSH connection: %s\n", err)
+			continue
+		}
+
+		// Connections are limited before the handshake, so refused addresses can't make the server check keys
+		remoteAddr, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			remoteAddr = conn.RemoteAddr().String()
+		}
+		if reason := server.admitConnection(remoteAddr, "ssh"); reason != "" {
+			conn.Close()
+			continue
+		}
+
+		go server.handleSSHConn(conn, remoteAddr, sshConfig)
+	}
+}
+
+// sshAdmission is an SSH connection's place in the connection limits.
+// It is handed to the client of the connection's session, or released when the connection closes without one.
+type sshAdmission struct {
+	lock    sync.Mutex
+	claimed bool
+}
+
+// claim takes the admission, returning false if it was already taken
+func (a *sshAdmission) claim() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.claimed {
+		return false
+	}
+	a.claimed = true
+	return true
+}
+
+// handleSSHConn does the SSH handshake, and puts the first session opened onto the chat server.
+// The connection must already have been admitted by the connection limiter.
+func (server *server) handleSSHConn(conn net.Conn, remoteAddr string, sshConfig *ssh.ServerConfig) {
+	admission := &sshAdmission{}
+	defer func() {
+		if admission.claim() {
+			server.connectionLimiter.release(remoteAddr)
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(sshHandshakeTimeout))
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, sshConfig)
+	if err != nil {
+		log.Printf("SSH handshake with %s failed: %s\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	go ssh.DiscardRequests(requests)
+
+	nick := sshConn.Permissions.Extensions["nick"]
+	started := false
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "Only sessions are supported")
+			continue
+		}
+		if started {
+			newChannel.Reject(ssh.Prohibited, "Only one session per connection is supported")
+			continue
+		}
+
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			log.Printf("Error accepting SSH session from %s: %s\n", conn.RemoteAddr(), err)
+			continue
+		}
+		started = true
+		go server.handleSSHSession(sshConn, channel, channelRequests, nick, remoteAddr, admission)
+	}
+}
+
+// handleSSHSession waits for the session to ask for a shell, and then connects it to the chat server.
+// If a pty was requested, the terminal provides line editing.
+// The client takes over the connection's admission, unless the connection already closed.
+func (server *server) handleSSHSession(sshConn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request, nick, remoteAddr string, admission *sshAdmission) {
+	pty := false
+	terminalType, width, height := "", 0, 0
+	var rw *sshSession
+	for request := range requests {
+		switch request.Type {
+		case "pty-req":
+			pty = true
+			terminalType, width, height, _ = parseSSHPtyRequest(request.Payload)
+			request.Reply(rw == nil, nil)
+		case "window-change":
+			if rw != nil && rw.terminal != nil {
+				if width, height, ok := parseSSHWindowChange(request.Payload); ok {
+					rw.terminal.SetSize(width, height)
+				}
+			}
+		case "shell":
+			if rw != nil || !admission.claim() {
+				request.Reply(false, nil)
+				continue
+			}
+			request.Reply(true, nil)
+
+			rw = &sshSession{conn: sshConn, channel: channel}
+			if pty {
+				rw.terminal = term.NewTerminal(channel, "")
+			}
+			vars := map[string]interface{}{"nick": nick}
+			if terminalType != "" {
+				vars["terminal_type"] = terminalType
+			}
+			if width > 0 && height > 0 {
+				vars["window_width"] = width
+				vars["window_height"] = height
+			}
+			if account, ok := server.sshAccount(nick); ok {
+				vars["nick"] = account
+				vars["account"] = account
+			}
+			server.addClient(rw, remoteAddr, "ssh", vars, initServerClientHandler{server}, true)
+		default:
+			// Commands and subsystems aren't supported; users only get the chat
+			if request.WantReply {
+				request.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// sshAccount gets the registered account for a nick, if there is one.
+// Users who logged in with a key listed for a nick are logged into its account.
+func (server *server) sshAccount(nick string) (string, bool) {
+	store := server.config.AccountStore
+	if store == nil {
+		return "", false
+	}
+
+	account, err := store.Account(nick)
+	if err != nil {
+		if err != ErrNoAccount {
+			log.Printf("Error looking up account for %s: %s\n", nick, err)
+		}
+		return "", false
+	}
+
+	return account.Nick, true
+}
+
+// checkSSHKey allows a user in if their key is listed for the nick they used as their SSH username.
+// The authorized keys file is read each time, so changes take effect right away.
+func (server *server) checkSSHKey(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	nick := meta.User()
+	keys, err := readSSHAuthorizedKeys(server.config.SSHAuthorizedKeysFile)
+	if err != nil {
+		log.Printf("Error reading SSH authorized keys: %s\n", err)
+		return nil, fmt.Errorf("Cannot check keys")
+	}
+
+	for _, authorized := range keys[strings.ToLower(nick)] {
+		if bytes.Equal(authorized.Marshal(), key.Marshal()) {
+			return &ssh.Permissions{Extensions: map[string]string{"nick": nick}}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Key not authorized for %s", nick)
+}
+
+// readSSHAuthorizedKeys reads a file mapping nicks to their public keys.
+// Each line has a nick, followed by a key as it appears in an authorized_keys file:
+//
+//	alice ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAA... alice@laptop
+//
+// Blank lines and lines starting with # are ignored.
+// The keys are returned by lowercase nick.
+func readSSHAuthorizedKeys(path string) (map[string][]ssh.PublicKey, error) {
+	keys := make(map[string][]ssh.PublicKey)
+	if path == "" {
+		return keys, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return keys, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		nick, keyText := splitFirstWord(line)
+		if !isValidNick(nick) {
+			log.Printf("%s:%d: invalid nick: %s\n", path, lineNumber, nick)
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keyText))
+		if err != nil {
+			log.Printf("%s:%d: %s\n", path, lineNumber, err)
+			continue
+		}
+
+		keys[strings.ToLower(nick)] = append(keys[strings.ToLower(nick)], key)
+	}
+
+	return keys, errors.Wrapf(scanner.Err(), "Cannot read %s", path)
+}
+
+// isValidNick returns true if nick can be used on the server
+func isValidNick(nick string) bool {
+	if nick == "" {
+		return false
+	}
+	for _, r := range nick {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// loadOrCreateSSHHostKey loads the server's host key.
+// If there is no key at path, a new ed25519 key is generated and saved there.
+func loadOrCreateSSHHostKey(path string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		signer, err := ssh.ParsePrivateKey(data)
+		return signer, errors.Wrapf(err, "Cannot parse SSH host key in %s", path)
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "Cannot read SSH host key")
+	}
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot generate SSH host key")
+	}
+	block, err := ssh.MarshalPrivateKey(privateKey, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot encode SSH host key")
+	}
+	if err := writeFileAtomically(path, pem.EncodeToMemory(block)); err != nil {
+		return nil, errors.Wrap(err, "Cannot save SSH host key")
+	}
+	log.Printf("Generated a new SSH host key in %s\n", path)
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	return signer, errors.Wrap(err, "Cannot use SSH host key")
+}
+
+// parseSSHPtyRequest gets the terminal type, width and height from a pty-req request
+func parseSSHPtyRequest(payload []byte) (string, int, int, bool) {
+	var pty struct {
+		Term                                   string
+		Width, Height, PixelWidth, PixelHeight uint32
+		Modes                                  string
+	}
+	if err := ssh.Unmarshal(payload, &pty); err != nil {
+		return "", 0, 0, false
+	}
+
+	return pty.Term, int(pty.Width), int(pty.Height), true
+}
+
+// parseSSHWindowChange gets the width and height from a window-change request
+func parseSSHWindowChange(payload []byte) (int, int, bool) {
+	var size struct {
+		Width, Height, PixelWidth, PixelHeight uint32
+	}
+	if err := ssh.Unmarshal(payload, &size); err != nil {
+		return 0, 0, false
+	}
+
+	return int(size.Width), int(size.Height), true
+}
+
+// sshSession is an SSH session that can be used by NewClient.
+// If the client asked for a pty, reads and writes go through terminal, which echoes and edits input lines.
+type sshSession struct {
+	conn      *ssh.ServerConn
+	channel   ssh.Channel
+	terminal  *term.Terminal // nil without a pty
+	pending   []byte         // Part of a line read from terminal that hasn't been read yet
+	closeOnce sync.Once
+}
+
+func (s *sshSession) Read(p []byte) (int, error) {
+	if s.terminal == nil {
+		return s.channel.Read(p)
+	}
+
+	// The terminal gives out whole lines, so they have to be split up if p is too small.
+	if len(s.pending) == 0 {
+		line, err := s.terminal.ReadLine()
+		if err != nil {
+			return 0, err
+		}
+		s.pending = []byte(line + "\n")
+	}
+
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *sshSession) Write(p []byte) (int, error) {
+	if s.terminal == nil {
+		return s.channel.Write(p)
+	}
+
+	return s.terminal.Write(p)
+}
+
+// Close ends the session, and the connection it was on.
+func (s *sshSession) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		s.channel.Close()
+		err = s.conn.Close()
+	})
+
+	return err
+}
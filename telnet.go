@@ -0,0 +1,359 @@
+package chatsrv
+
+import (
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Telnet commands and options
+const (
+	telnetIAC  = 255 // Interpret as command
+	telnetDONT = 254
+	telnetDO   = 253
+	telnetWONT = 252
+	telnetWILL = 251
+	telnetSB   = 250 // Subnegotiation begin
+	telnetGA   = 249 // Go ahead; marks a prompt
+	telnetSE   = 240 // Subnegotiation end
+	telnetEOR  = 239 // End of record; marks a prompt, once the EOR option is on
+
+	telnetOptEcho  = 1
+	telnetOptTType = 24 // Terminal type
+	telnetOptEOR   = 25
+	telnetOptNAWS  = 31 // Negotiate about window size
+	telnetOptMCCP2 = 86 // Compression
+	telnetOptGMCP  = 201
+
+	telnetTTypeIs   = 0
+	telnetTTypeSend = 1
+)
+
+// Longest subnegotiation that is kept; the rest is ignored.
+// Terminal types and window sizes are much shorter, but GMCP messages can list a lot of packages.
+const telnetMaxSubnegotiation = 4096
+
+var (
+	// Tells the client the server will echo input, so the client stops echoing it locally.
+	telnetEchoOff = []byte{telnetIAC, telnetWILL, telnetOptEcho}
+	// Tells the client to go back to echoing input itself.
+	telnetEchoOn = []byte{telnetIAC, telnetWONT, telnetOptEcho}
+)
+
+// States of the telnet input parser
+const (
+	telnetStateData   = iota
+	telnetStateIAC    // Got IAC
+	telnetStateOption // Got IAC and WILL, WONT, DO or DONT
+	telnetStateSB     // In a subnegotiation
+	telnetStateSBIAC  // Got IAC in a subnegotiation
+)
+
+// telnetConn wraps the connection of a telnet client.
+// It takes telnet commands out of the input, answers the client's option negotiation,
+// and asks for the client's terminal type and window size.
+// What it learns is stored in the client's vars, once attach has been called:
+// "terminal_type" is a string, and "window_width" and "window_height" are ints.
+// Output is written as is; escaping IAC bytes is up to whoever sends it.
+// If compress is true, MCCP2 is offered; once the client agrees, everything written is compressed.
+type telnetConn struct {
+	conn     io.ReadWriteCloser
+	compress bool
+
+	// Holding a value in writing keeps negotiation from being written in the middle of other output.
+	// It is a channel, rather than a mutex, so Close can tell if a write is blocked.
+	writing    chan struct{}
+	compressor *zlib.Writer // Compresses everything written, once MCCP2 has started; nil until then
+
+	// Only used by Read
+	state  int
+	verb   byte   // WILL, WONT, DO or DONT, while in telnetStateOption
+	sbData []byte // Subnegotiation being received
+
+	lock         sync.Mutex // protects everything below
+	client       *Client
+	terminalType string
+	width        int
+	height       int
+	eor          bool            // The client agreed to have prompts marked with EOR, rather than GA
+	gmcp         bool            // The client agreed to GMCP
+	gmcpSupports map[string]bool // GMCP packages the client wants, by lowercase name; nil if it didn't say
+	// Bytes written before and after compression, while MCCP2 was on
+	uncompressedBytes int64
+	compressedBytes   int64
+}
+
+func newTelnetConn(conn io.ReadWriteCloser, compress bool) *telnetConn {
+	return &telnetConn{conn: conn, compress: compress, writing: make(chan struct{}, 1)}
+}
+
+// attach lets the telnet connection store what it learns in client's vars, and starts negotiating options.
+func (t *telnetConn) attach(client *Client) {
+	t.lock.Lock()
+	t.client = client
+	if t.terminalType != "" {
+		client.SetVar("terminal_type", t.terminalType)
+	}
+	if t.width > 0 && t.height > 0 {
+		client.SetVar("window_width", t.width)
+		client.SetVar("window_height", t.height)
+	}
+	t.lock.Unlock()
+	client.SetVar("telnet", t)
+
+	t.writeCommand(
+		telnetIAC, telnetDO, telnetOptTType,
+		telnetIAC, telnetDO, telnetOptNAWS,
+		telnetIAC, telnetWILL, telnetOptEOR,
+		telnetIAC, telnetWILL, telnetOptGMCP,
+	)
+	if t.compress {
+		t.writeCommand(telnetIAC, telnetWILL, telnetOptMCCP2)
+	}
+}
+
+// promptEnd returns what should be sent after a prompt, so clients know it is one,
+// even though it doesn't end with a newline.
+func (t *telnetConn) promptEnd() []byte {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.eor {
+		return []byte{telnetIAC, telnetEOR}
+	}
+
+	return []byte{telnetIAC, telnetGA}
+}
+
+// Read reads data from the client, with telnet commands taken out.
+func (t *telnetConn) Read(p []byte) (int, error) {
+	for {
+		n, err := t.conn.Read(p)
+		n = t.filter(p[:n])
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// filter takes telnet commands out of data, handling them along the way.
+// The data left is moved to the start of the slice, and its length is returned.
+// Commands split across reads are picked up where they left off.
+func (t *telnetConn) filter(data []byte) int {
+	n := 0
+	for _, b := range data {
+		switch t.state {
+		case telnetStateData:
+			if b == telnetIAC {
+				t.state = telnetStateIAC
+				continue
+			}
+			data[n] = b
+			n++
+		case telnetStateIAC:
+			switch b {
+			case telnetIAC:
+				// Escaped 0xFF
+				data[n] = b
+				n++
+				t.state = telnetStateData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				t.verb = b
+				t.state = telnetStateOption
+			case telnetSB:
+				t.sbData = t.sbData[:0]
+				t.state = telnetStateSB
+			default:
+				// Other commands, such as NOP or GA, don't mean anything here
+				t.state = telnetStateData
+			}
+		case telnetStateOption:
+			t.negotiate(t.verb, b)
+			t.state = telnetStateData
+		case telnetStateSB:
+			if b == telnetIAC {
+				t.state = telnetStateSBIAC
+				continue
+			}
+			if len(t.sbData) < telnetMaxSubnegotiation {
+				t.sbData = append(t.sbData, b)
+			}
+		case telnetStateSBIAC:
+			switch b {
+			case telnetSE:
+				t.subnegotiate(t.sbData)
+				t.state = telnetStateData
+			case telnetIAC:
+				if len(t.sbData) < telnetMaxSubnegotiation {
+					t.sbData = append(t.sbData, b)
+				}
+				t.state = telnetStateSB
+			default:
+				// Shouldn't happen; give up on the subnegotiation
+				t.state = telnetStateData
+			}
+		}
+	}
+
+	return n
+}
+
+// negotiate answers the client's WILL, WONT, DO or DONT for an option.
+// Options the server doesn't know about are refused; refusals are never answered, so negotiation can't loop.
+func (t *telnetConn) negotiate(verb, option byte) {
+	switch verb {
+	case telnetWILL:
+		switch option {
+		case telnetOptTType:
+			t.writeCommand(telnetIAC, telnetSB, telnetOptTType, telnetTTypeSend, telnetIAC, telnetSE)
+		case telnetOptNAWS:
+			// The client sends its window size right after agreeing
+		default:
+			t.writeCommand(telnetIAC, telnetDONT, option)
+		}
+	case telnetDO:
+		switch option {
+		case telnetOptEOR:
+			t.lock.Lock()
+			t.eor = true
+			t.lock.Unlock()
+		case telnetOptGMCP:
+			t.lock.Lock()
+			t.gmcp = true
+			t.lock.Unlock()
+		case telnetOptMCCP2:
+			if t.compress {
+				t.startCompression()
+			} else {
+				t.writeCommand(telnetIAC, telnetWONT, option)
+			}
+		case telnetOptEcho:
+			// The answer to the WILL ECHO sent while passwords are typed
+		default:
+			t.writeCommand(telnetIAC, telnetWONT, option)
+		}
+	case telnetDONT:
+		if option == telnetOptMCCP2 {
+			t.lockWriting()
+			t.endCompression()
+			t.unlockWriting()
+			return
+		}
+
+		t.lock.Lock()
+		switch option {
+		case telnetOptEOR:
+			t.eor = false
+		case telnetOptGMCP:
+			t.gmcp = false
+		}
+		t.lock.Unlock()
+	}
+}
+
+// subnegotiate handles a subnegotiation from the client, such as its terminal type or window size.
+func (t *telnetConn) subnegotiate(data []byte) {
+	if len(data) < 1 {
+		return
+	}
+
+	switch data[0] {
+	case telnetOptTType:
+		if len(data) < 2 || data[1] != telnetTTypeIs {
+			return
+		}
+		terminalType := string(data[2:])
+		t.lock.Lock()
+		t.terminalType = terminalType
+		if t.client != nil {
+			t.client.SetVar("terminal_type", terminalType)
+		}
+		t.lock.Unlock()
+	case telnetOptNAWS:
+		if len(data) != 5 {
+			return
+		}
+		width := int(data[1])<<8 | int(data[2])
+		height := int(data[3])<<8 | int(data[4])
+		t.lock.Lock()
+		t.width, t.height = width, height
+		if t.client != nil {
+			t.client.SetVar("window_width", width)
+			t.client.SetVar("window_height", height)
+		}
+		t.lock.Unlock()
+	case telnetOptGMCP:
+		t.receiveGMCP(string(data[1:]))
+	}
+}
+
+// writeCommand sends a telnet command straight to the client.
+func (t *telnetConn) writeCommand(command ...byte) {
+	t.Write(command)
+}
+
+func (t *telnetConn) Write(p []byte) (int, error) {
+	t.lockWriting()
+	defer t.unlockWriting()
+	if t.compressor != nil {
+		return t.writeCompressed(p)
+	}
+
+	return t.conn.Write(p)
+}
+
+// Close closes the connection.
+// If the output is compressed, the compressed stream is ended first,
+// unless a write is blocked, such as when the client was aborted because it stopped reading.
+func (t *telnetConn) Close() error {
+	select {
+	case t.writing <- struct{}{}:
+		t.endCompression()
+		t.unlockWriting()
+	default:
+	}
+
+	return t.conn.Close()
+}
+
+func (t *telnetConn) lockWriting() {
+	t.writing <- struct{}{}
+}
+
+func (t *telnetConn) unlockWriting() {
+	<-t.writing
+}
+
+// describeTerminal says what is known about a telnet client's terminal, such as "xterm, 80x24".
+// Returns "" if nothing is known.
+func describeTerminal(client *Client) string {
+	description, _ := client.GetVar("terminal_type").(string)
+	width, _ := client.GetVar("window_width").(int)
+	height, _ := client.GetVar("window_height").(int)
+	if width > 0 && height > 0 {
+		if description != "" {
+			description += ", "
+		}
+		description += fmt.Sprintf("%dx%d", width, height)
+	}
+
+	return description
+}
+
+// speaksTelnet returns true if telnet commands can be sent to the client.
+// Clients that connected some other way, such as over a websocket, would see them as garbage.
+func speaksTelnet(client *Client) bool {
+	_, ok := client.GetVar("telnet").(*telnetConn)
+	return ok
+}
+
+// telnetPromptEnd returns what should be sent after a prompt to the client.
+// Returns nil if the client doesn't speak telnet.
+func telnetPromptEnd(client *Client) []byte {
+	t, ok := client.GetVar("telnet").(*telnetConn)
+	if !ok {
+		return nil
+	}
+
+	return t.promptEnd()
+}
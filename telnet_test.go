@@ -0,0 +1,194 @@
+package chatsrv
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// fakeConn is a connection that returns reads one at a time, and keeps what is written to it
+type fakeConn struct {
+	reads   [][]byte
+	written bytes.Buffer
+	closed  bool
+}
+
+func (c *fakeConn) Read(p []byte) (int, error) {
+	if len(c.reads) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.reads[0])
+	if n < len(c.reads[0]) {
+		c.reads[0] = c.reads[0][n:]
+	} else {
+		c.reads = c.reads[1:]
+	}
+
+	return n, nil
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// readAll reads everything from a telnet connection, until the fake connection under it runs out
+func readAll(t *testing.T, telnet *telnetConn) []byte {
+	var data []byte
+	buf := make([]byte, 3) // Small, so reads get split up too
+	for {
+		n, err := telnet.Read(buf)
+		data = append(data, buf[:n]...)
+		if err == io.EOF {
+			return data
+		}
+		if err != nil {
+			t.Fatalf("error reading: %s", err)
+		}
+	}
+}
+
+func TestTelnetConnRead(t *testing.T) {
+	iac := byte(telnetIAC)
+	tests := []struct {
+		name    string
+		reads   [][]byte
+		want    string // Data left once telnet commands are taken out
+		written []byte // What the server answers
+	}{
+		{"plain data", [][]byte{[]byte("hello\r\n")}, "hello\r\n", nil},
+		{"escaped IAC", [][]byte{{'a', iac, iac, 'b'}}, "a\xffb", nil},
+		{"escaped IAC split across reads", [][]byte{{'a', iac}, {iac, 'b'}}, "a\xffb", nil},
+		{"other commands are dropped", [][]byte{{'a', iac, 241, 'b', iac, telnetGA}}, "ab", nil},
+		{"WILL TTYPE asks for the terminal type", [][]byte{{iac, telnetWILL, telnetOptTType}},
+			"", []byte{iac, telnetSB, telnetOptTType, telnetTTypeSend, iac, telnetSE}},
+		{"WILL NAWS isn't answered", [][]byte{{iac, telnetWILL, telnetOptNAWS}}, "", nil},
+		{"unknown WILL is refused", [][]byte{{iac, telnetWILL, 99}}, "", []byte{iac, telnetDONT, 99}},
+		{"unknown DO is refused", [][]byte{{iac, telnetDO, 99}}, "", []byte{iac, telnetWONT, 99}},
+		{"refusals aren't answered", [][]byte{{iac, telnetWONT, 99, iac, telnetDONT, 99}}, "", nil},
+		{"DO ECHO isn't answered", [][]byte{{iac, telnetDO, telnetOptEcho}}, "", nil},
+		{"DO MCCP2 is refused without compression", [][]byte{{iac, telnetDO, telnetOptMCCP2}}, "", []byte{iac, telnetWONT, telnetOptMCCP2}},
+		{"negotiation split across reads", [][]byte{{'a', iac}, {telnetDO}, {99, 'b'}}, "ab", []byte{iac, telnetWONT, 99}},
+		{"subnegotiation is taken out", [][]byte{{'a', iac, telnetSB, 99, 1, 2, iac, telnetSE, 'b'}}, "ab", nil},
+		{"broken subnegotiation is given up on", [][]byte{{iac, telnetSB, 99, 1, iac, 'x', 'y'}}, "y", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := &fakeConn{reads: test.reads}
+			telnet := newTelnetConn(conn, false)
+			if got := string(readAll(t, telnet)); got != test.want {
+				t.Errorf("read %q, want %q", got, test.want)
+			}
+			if got := conn.written.Bytes(); !bytes.Equal(got, test.written) {
+				t.Errorf("wrote %v, want %v", got, test.written)
+			}
+		})
+	}
+}
+
+func TestTelnetConnSubnegotiation(t *testing.T) {
+	iac := byte(telnetIAC)
+	tests := []struct {
+		name         string
+		reads        [][]byte
+		terminalType string
+		width        int
+		height       int
+	}{
+		{"terminal type", [][]byte{{iac, telnetSB, telnetOptTType, telnetTTypeIs, 'x', 't', 'e', 'r', 'm', iac, telnetSE}}, "xterm", 0, 0},
+		{"terminal type split across reads", [][]byte{{iac, telnetSB, telnetOptTType}, {telnetTTypeIs, 'x', 't'}, {'e', 'r', 'm', iac}, {telnetSE}}, "xterm", 0, 0},
+		{"terminal type without IS", [][]byte{{iac, telnetSB, telnetOptTType, telnetTTypeSend, iac, telnetSE}}, "", 0, 0},
+		{"window size", [][]byte{{iac, telnetSB, telnetOptNAWS, 0, 80, 0, 24, iac, telnetSE}}, "", 80, 24},
+		{"big window size", [][]byte{{iac, telnetSB, telnetOptNAWS, 1, 44, 0, 50, iac, telnetSE}}, "", 300, 50},
+		{"window size with an escaped IAC", [][]byte{{iac, telnetSB, telnetOptNAWS, 0, iac, iac, 0, 24, iac, telnetSE}}, "", 255, 24},
+		{"window size split across reads", [][]byte{{iac, telnetSB, telnetOptNAWS, 0}, {80}, {0, 24, iac}, {telnetSE}}, "", 80, 24},
+		{"window size of the wrong length", [][]byte{{iac, telnetSB, telnetOptNAWS, 0, 80, 0, iac, telnetSE}}, "", 0, 0},
+		{"later size wins", [][]byte{{iac, telnetSB, telnetOptNAWS, 0, 80, 0, 24, iac, telnetSE, iac, telnetSB, telnetOptNAWS, 0, 132, 0, 43, iac, telnetSE}}, "", 132, 43},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			telnet := newTelnetConn(&fakeConn{reads: test.reads}, false)
+			if data := readAll(t, telnet); len(data) != 0 {
+				t.Errorf("read %q, want nothing", data)
+			}
+			if telnet.terminalType != test.terminalType {
+				t.Errorf("terminal type = %q, want %q", telnet.terminalType, test.terminalType)
+			}
+			if telnet.width != test.width || telnet.height != test.height {
+				t.Errorf("window size = %dx%d, want %dx%d", telnet.width, telnet.height, test.width, test.height)
+			}
+		})
+	}
+}
+
+func TestTelnetConnLongSubnegotiation(t *testing.T) {
+	iac := byte(telnetIAC)
+	read := []byte{iac, telnetSB, telnetOptTType, telnetTTypeIs}
+	read = append(read, bytes.Repeat([]byte{'x'}, telnetMaxSubnegotiation*2)...)
+	read = append(read, iac, telnetSE, 'o', 'k')
+
+	telnet := newTelnetConn(&fakeConn{reads: [][]byte{read}}, false)
+	if data := string(readAll(t, telnet)); data != "ok" {
+		t.Errorf("read %q, want \"ok\"", data)
+	}
+	if len(telnet.terminalType) != telnetMaxSubnegotiation-2 {
+		t.Errorf("terminal type is %d bytes, want it cut off at %d", len(telnet.terminalType), telnetMaxSubnegotiation-2)
+	}
+}
+
+func TestTelnetConnAttach(t *testing.T) {
+	iac := byte(telnetIAC)
+	conn := &fakeConn{reads: [][]byte{{iac, telnetSB, telnetOptTType, telnetTTypeIs, 'a', 'n', 's', 'i', iac, telnetSE}}}
+	telnet := newTelnetConn(conn, false)
+	readAll(t, telnet)
+
+	// What was learned before attaching is stored in the client's vars when it attaches
+	client := newTestClient(nil)
+	telnet.attach(client)
+	if terminalType, _ := client.GetVar("terminal_type").(string); terminalType != "ansi" {
+		t.Errorf("terminal_type = %q, want \"ansi\"", terminalType)
+	}
+	want := []byte{
+		iac, telnetDO, telnetOptTType,
+		iac, telnetDO, telnetOptNAWS,
+		iac, telnetWILL, telnetOptEOR,
+		iac, telnetWILL, telnetOptGMCP,
+	}
+	if got := conn.written.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("attach wrote %v, want %v", got, want)
+	}
+
+	// And what is learned afterwards is stored right away
+	conn.reads = [][]byte{{iac, telnetSB, telnetOptNAWS, 0, 100, 0, 30, iac, telnetSE}}
+	readAll(t, telnet)
+	if describeTerminal(client) != "ansi, 100x30" {
+		t.Errorf("terminal is %q, want \"ansi, 100x30\"", describeTerminal(client))
+	}
+}
+
+func TestTelnetConnPromptEnd(t *testing.T) {
+	iac := byte(telnetIAC)
+	conn := &fakeConn{}
+	telnet := newTelnetConn(conn, false)
+	if got := telnet.promptEnd(); !bytes.Equal(got, []byte{iac, telnetGA}) {
+		t.Errorf("prompts end with %v before EOR is agreed to, want IAC GA", got)
+	}
+
+	conn.reads = [][]byte{{iac, telnetDO, telnetOptEOR}}
+	readAll(t, telnet)
+	if got := telnet.promptEnd(); !bytes.Equal(got, []byte{iac, telnetEOR}) {
+		t.Errorf("prompts end with %v after DO EOR, want IAC EOR", got)
+	}
+
+	conn.reads = [][]byte{{iac, telnetDONT, telnetOptEOR}}
+	readAll(t, telnet)
+	if got := telnet.promptEnd(); !bytes.Equal(got, []byte{iac, telnetGA}) {
+		t.Errorf("prompts end with %v after DONT EOR, want IAC GA", got)
+	}
+}
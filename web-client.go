@@ -0,0 +1,66 @@
+package chatsrv
+
+// webClientPage is served to browsers by the web listener.
+// It connects to /ws, and speaks the same line protocol as a telnet client.
+const webClientPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Chat</title>
+<style>
+body { margin: 0; display: flex; flex-direction: column; height: 100vh; font-family: monospace; }
+#output { flex: 1; overflow-y: auto; margin: 0; padding: 0.5em; white-space: pre-wrap; word-wrap: break-word; }
+#form { display: flex; border-top: 1px solid #888; }
+#input { flex: 1; font: inherit; padding: 0.5em; border: none; }
+</style>
+</head>
+<body>
+<pre id="output" role="log" aria-live="polite"></pre>
+<form id="form">
+<input id="input" autocomplete="off" autofocus aria-label="Message or command">
+</form>
+<script>
+(function() {
+	var output = document.getElementById("output");
+	var form = document.getElementById("form");
+	var input = document.getElementById("input");
+	var decoder = new TextDecoder("utf-8");
+	var protocol = location.protocol === "https:" ? "wss:" : "ws:";
+	var ws = new WebSocket(protocol + "//" + location.host + "/ws");
+	ws.binaryType = "arraybuffer";
+
+	function print(text) {
+		var atBottom = output.scrollTop + output.clientHeight >= output.scrollHeight - 5;
+		output.appendChild(document.createTextNode(text));
+		if (atBottom) {
+			output.scrollTop = output.scrollHeight;
+		}
+	}
+
+	ws.onmessage = function(event) {
+		var text = decoder.decode(new Uint8Array(event.data), {stream: true});
+		print(text);
+		// Hide passwords while they are typed
+		input.type = /Password: $/.test(text) ? "password" : "text";
+	};
+	ws.onclose = function() {
+		print("\n[Disconnected]\n");
+		input.disabled = true;
+	};
+
+	form.onsubmit = function(event) {
+		event.preventDefault();
+		if (ws.readyState !== WebSocket.OPEN) {
+			return;
+		}
+		ws.send(input.value + "\n");
+		if (input.type !== "password") {
+			print(input.value + "\n");
+		}
+		input.value = "";
+	};
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,145 @@
+package chatsrv
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+)
+
+// wsConn makes a websocket connection look like a stream, so it can be used by NewClient.
+// Incoming messages are read back to back, so clients must end lines with "\n" themselves.
+// Each write is sent as a binary message, as output isn't guaranteed to be valid UTF-8.
+type wsConn struct {
+	conn      *websocket.Conn
+	reader    io.Reader // Reads the message currently being received
+	closeOnce sync.Once
+}
+
+// Time allowed for the close message to be written when the connection is closed
+const wsCloseTimeout = time.Second
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			_, reader, err := c.conn.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close says goodbye to the browser, and closes the connection.
+// It is safe to call more than once, and while a write is in progress.
+func (c *wsConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsCloseTimeout))
+		err = c.conn.Close()
+	})
+
+	return err
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// serveWeb runs the HTTP listener for browsers on config.WebBindAddr.
+// It serves the web client at /, and accepts websocket connections at /ws.
+func (server *server) serveWeb() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.handleWebClient)
+	mux.HandleFunc("/ws", server.handleWebSocket)
+	httpServer := &http.Server{Addr: server.config.WebBindAddr, Handler: mux}
+
+	server.runningLock.Lock()
+	if server.shuttingDown {
+		server.runningLock.Unlock()
+		return
+	}
+	server.webServer = httpServer
+	server.runningLock.Unlock()
+
+	var err error
+	if server.config.UseTls {
+		log.Printf("Listening for web clients on %s with TLS enabled\n", server.config.WebBindAddr)
+		err = httpServer.ListenAndServeTLS(server.config.CertFile, server.config.KeyFile)
+	} else {
+		log.Printf("Listening for web clients on %s\n", server.config.WebBindAddr)
+		err = httpServer.ListenAndServe()
+	}
+
+	if err == http.ErrServerClosed {
+		log.Printf("Stopped listening for web clients on %s\n", server.config.WebBindAddr)
+	} else {
+		log.Printf("Cannot serve web clients on %s; %s\n", server.config.WebBindAddr, err)
+	}
+}
+
+// handleWebClient serves the page with the browser client
+func (server *server) handleWebClient(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, webClientPage)
+}
+
+// handleWebSocket upgrades a connection from a browser, and puts it onto the chat server
+func (server *server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if server.isShuttingDown() {
+		http.Error(w, "The server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	remoteAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddr = r.RemoteAddr
+	}
+	// Refuse connections before upgrading them, so refused addresses can't hold websockets open
+	if reason := server.admitConnection(remoteAddr, "websocket"); reason != "" {
+		http.Error(w, reason, http.StatusForbidden)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already responded with an error
+		log.Printf("Error accepting websocket connection from %s: %s\n", r.RemoteAddr, err)
+		server.connectionLimiter.release(remoteAddr)
+		return
+	}
+
+	server.addClient(&wsConn{conn: conn}, remoteAddr, "websocket", nil, initServerClientHandler{server}, true)
+}